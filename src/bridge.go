@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"senhaerens.be/hap-mqtt/config"
+	"senhaerens.be/hap-mqtt/devices"
+	"senhaerens.be/hap-mqtt/store"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/charmbracelet/log"
+)
+
+// bridge keeps the bridged devices in sync with the device configuration.
+type bridge struct {
+	mu      sync.Mutex
+	subs    *devices.Subscriptions
+	pub     *devices.Publisher
+	ids     *store.IDs
+	state   *store.State
+	devices map[string]*bridgedDevice
+	order   []string
+}
+
+type bridgedDevice struct {
+	devices.Device
+	config config.Device
+	client *devices.Client
+}
+
+// close removes the subscriptions and stops the background work of the device.
+func (d *bridgedDevice) close() {
+	if c, ok := d.Device.(devices.Closer); ok {
+		c.Close()
+	}
+	d.client.Close()
+}
+
+func newBridge(subs *devices.Subscriptions, pub *devices.Publisher, ids *store.IDs, state *store.State) *bridge {
+	return &bridge{
+		subs:    subs,
+		pub:     pub,
+		ids:     ids,
+		state:   state,
+		devices: map[string]*bridgedDevice{},
+	}
+}
+
+// update recreates the configured devices and removes devices which are
+// no longer configured. Devices which fail to be created are skipped.
+//
+// Unchanged devices are recreated as well, as a new HAP server registers
+// its notification handlers on every characteristic. They restore their
+// persisted state and receive the last messages replayed by the shared
+// subscriptions.
+func (b *bridge) update(configs map[string][]config.Device) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var errs []error
+	current := map[string]*bridgedDevice{}
+	var order []string
+	ids := assignIDs(b.ids, configs)
+
+	for _, driver := range devices.Drivers() {
+		for _, config := range configs[driver.Key] {
+			key := driver.Key + "/" + config.Name
+			id := ids[key]
+
+			if old, ok := b.devices[key]; ok && !reflect.DeepEqual(old.config, config) {
+				log.Infof("HAP Update Accessory %4d - %s", id, config.Name)
+			}
+
+			device, err := driver.New(int(id), config)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %q: %w", driver.Key, config.Name, err))
+				continue
+			}
+
+			// Restore the last known state before new messages arrive
+			b.state.Track(device.Accessory())
+			if p, ok := device.(devices.StatePersister); ok {
+				p.RestoreState(b.state.Scope(id))
+			}
+
+			client := b.subs.Client(b.pub)
+			device.Listen(client)
+			// Otherwise requested by connected
+			if r, ok := device.(devices.StateRequester); ok && client.IsConnectionOpen() {
+				r.RequestState(client)
+			}
+			current[key] = &bridgedDevice{Device: device, config: config, client: client}
+			order = append(order, key)
+		}
+	}
+
+	// Link the devices referencing others once all of them listen
+	lookup := func(name string) []devices.Device {
+		var found []devices.Device
+		for _, key := range order {
+			if d := current[key]; d.config.Name == name {
+				found = append(found, d.Device)
+			}
+		}
+		return found
+	}
+	linked := order[:0:0]
+	for _, key := range order {
+		d := current[key]
+		if l, ok := d.Device.(devices.Linker); ok {
+			if err := l.Link(lookup); err != nil {
+				errs = append(errs, fmt.Errorf("%s %q: %w", strings.Split(key, "/")[0], d.config.Name, err))
+				d.close()
+				delete(current, key)
+				continue
+			}
+		}
+		linked = append(linked, key)
+	}
+	order = linked
+
+	// Close the replaced devices after the new ones subscribed, so shared
+	// topics stay subscribed at the broker
+	for key, old := range b.devices {
+		if _, ok := current[key]; !ok {
+			log.Infof("HAP Remove Accessory %4d - %s", old.Accessory().Id, old.config.Name)
+		}
+		old.close()
+	}
+
+	b.devices = current
+	b.order = order
+
+	inUse := map[uint64]bool{}
+	for _, d := range current {
+		inUse[d.Accessory().Id] = true
+	}
+	b.state.Prune(inUse)
+
+	b.ids.RetireUnused()
+	if err := b.ids.Save(); err != nil {
+		errs = append(errs, fmt.Errorf("saving accessory IDs: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// assignIDs returns the accessory IDs of the configured devices by key.
+// Devices of drivers with legacy IDs come first, so on the first run a
+// device of a newer driver cannot take the legacy ID of an existing device,
+// which would lose its room and scenes in HomeKit.
+func assignIDs(ids *store.IDs, configs map[string][]config.Device) map[string]uint64 {
+	assigned := map[string]uint64{}
+	for _, withLegacy := range []bool{true, false} {
+		for _, driver := range devices.Drivers() {
+			if (driver.Offset > 0) != withLegacy {
+				continue
+			}
+			for i, config := range configs[driver.Key] {
+				var legacy uint64
+				if driver.Offset > 0 {
+					legacy = uint64(i + driver.Offset)
+				}
+				assigned[driver.Key+"/"+config.Name] = ids.ID(driver.Key, config.Name, legacy)
+			}
+		}
+	}
+
+	return assigned
+}
+
+// connected resubscribes all topics and requests the state of every device
+// after the MQTT client (re)connected.
+func (b *bridge) connected() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subs.Resubscribe()
+	devices.SetBrokerConnected(true)
+
+	for _, key := range b.order {
+		d := b.devices[key]
+		if r, ok := d.Device.(devices.StateRequester); ok {
+			r.RequestState(d.client)
+		}
+	}
+}
+
+// accessories returns the accessories in driver and configuration order.
+func (b *bridge) accessories() []*accessory.A {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	as := make([]*accessory.A, len(b.order))
+	for i, key := range b.order {
+		as[i] = b.devices[key].Accessory()
+	}
+
+	return as
+}
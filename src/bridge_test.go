@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"senhaerens.be/hap-mqtt/config"
+	"senhaerens.be/hap-mqtt/store"
+)
+
+func TestAssignIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs map[string][]config.Device
+		want    map[string]uint64
+	}{
+		{
+			name: "legacy IDs",
+			configs: map[string][]config.Device{
+				"tasmota_plugs":   {{Name: "plug_1"}, {Name: "plug_2"}},
+				"contact_sensors": {{Name: "door"}},
+			},
+			want: map[string]uint64{"tasmota_plugs/plug_1": 2, "tasmota_plugs/plug_2": 3, "contact_sensors/door": 300},
+		},
+		{
+			name: "new driver sorting before a legacy one",
+			configs: map[string][]config.Device{
+				"generic":       {{Name: "pump"}},
+				"tasmota_plugs": {{Name: "plug_1"}},
+			},
+			want: map[string]uint64{"tasmota_plugs/plug_1": 2, "generic/pump": 3},
+		},
+		{
+			name: "new drivers after all legacy IDs",
+			configs: map[string][]config.Device{
+				"generic":         {{Name: "pump"}},
+				"contact_sensors": {{Name: "door"}},
+				"thermostats":     {{Name: "living_room"}},
+				"tasmota_plugs":   {{Name: "plug_1"}},
+			},
+			want: map[string]uint64{"tasmota_plugs/plug_1": 2, "contact_sensors/door": 300, "generic/pump": 301, "thermostats/living_room": 302},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, err := store.LoadIDs(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := assignIDs(ids, tt.configs)
+			for key, want := range tt.want {
+				if got[key] != want {
+					t.Errorf("ID of %s = %d, want %d", key, got[key], want)
+				}
+			}
+		})
+	}
+}
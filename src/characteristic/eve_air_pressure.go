@@ -0,0 +1,25 @@
+package characteristic
+
+import (
+	"github.com/brutella/hap/characteristic"
+)
+
+const TypeEveAirPressure = "E863F10F-079E-48FF-8F27-9C2605A29F52"
+
+type EveAirPressure struct {
+	*characteristic.Float
+}
+
+// NewEveAirPressure creates the air pressure characteristic, in hPa.
+func NewEveAirPressure() *EveAirPressure {
+	c := characteristic.NewFloat(TypeEveAirPressure)
+	c.Format = characteristic.FormatFloat
+	c.Permissions = []string{characteristic.PermissionRead, characteristic.PermissionEvents}
+	c.Description = "Air Pressure"
+	c.SetMinValue(700)
+	c.SetMaxValue(1100)
+	c.SetStepValue(0.1)
+	c.SetValue(1013)
+
+	return &EveAirPressure{c}
+}
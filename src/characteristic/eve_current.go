@@ -0,0 +1,25 @@
+package characteristic
+
+import (
+	"github.com/brutella/hap/characteristic"
+)
+
+const TypeEveCurrent = "E863F126-079E-48FF-8F27-9C2605A29F52"
+
+type EveCurrent struct {
+	*characteristic.Float
+}
+
+// NewEveCurrent creates the electric current characteristic, in A.
+func NewEveCurrent() *EveCurrent {
+	c := characteristic.NewFloat(TypeEveCurrent)
+	c.Format = characteristic.FormatFloat
+	c.Permissions = []string{characteristic.PermissionRead, characteristic.PermissionEvents}
+	c.Description = "Current"
+	c.SetMinValue(0)
+	c.SetMaxValue(1000000)
+	c.SetStepValue(0.01)
+	c.SetValue(0)
+
+	return &EveCurrent{c}
+}
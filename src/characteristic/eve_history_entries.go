@@ -0,0 +1,21 @@
+package characteristic
+
+import (
+	"github.com/brutella/hap/characteristic"
+)
+
+const TypeEveHistoryEntries = "E863F117-079E-48FF-8F27-9C2605A29F52"
+
+type EveHistoryEntries struct {
+	*characteristic.Bytes
+}
+
+// NewEveHistoryEntries creates the characteristic serving the history entries (S2R2).
+func NewEveHistoryEntries() *EveHistoryEntries {
+	c := characteristic.NewBytes(TypeEveHistoryEntries)
+	c.Format = characteristic.FormatData
+	c.Permissions = []string{characteristic.PermissionRead, characteristic.PermissionEvents, characteristic.PermissionHidden}
+	c.SetValue([]byte{})
+
+	return &EveHistoryEntries{c}
+}
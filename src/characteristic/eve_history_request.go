@@ -0,0 +1,21 @@
+package characteristic
+
+import (
+	"github.com/brutella/hap/characteristic"
+)
+
+const TypeEveHistoryRequest = "E863F11C-079E-48FF-8F27-9C2605A29F52"
+
+type EveHistoryRequest struct {
+	*characteristic.Bytes
+}
+
+// NewEveHistoryRequest creates the characteristic requesting the entries from an index (S2W1).
+func NewEveHistoryRequest() *EveHistoryRequest {
+	c := characteristic.NewBytes(TypeEveHistoryRequest)
+	c.Format = characteristic.FormatData
+	c.Permissions = []string{characteristic.PermissionWrite, characteristic.PermissionHidden}
+	c.SetValue([]byte{})
+
+	return &EveHistoryRequest{c}
+}
@@ -0,0 +1,21 @@
+package characteristic
+
+import (
+	"github.com/brutella/hap/characteristic"
+)
+
+const TypeEveHistoryStatus = "E863F116-079E-48FF-8F27-9C2605A29F52"
+
+type EveHistoryStatus struct {
+	*characteristic.Bytes
+}
+
+// NewEveHistoryStatus creates the history status characteristic (S2R1).
+func NewEveHistoryStatus() *EveHistoryStatus {
+	c := characteristic.NewBytes(TypeEveHistoryStatus)
+	c.Format = characteristic.FormatData
+	c.Permissions = []string{characteristic.PermissionRead, characteristic.PermissionEvents, characteristic.PermissionHidden}
+	c.SetValue([]byte{})
+
+	return &EveHistoryStatus{c}
+}
@@ -0,0 +1,25 @@
+package characteristic
+
+import (
+	"github.com/brutella/hap/characteristic"
+)
+
+const TypeEvePower = "E863F10D-079E-48FF-8F27-9C2605A29F52"
+
+type EvePower struct {
+	*characteristic.Float
+}
+
+// NewEvePower creates the power consumption characteristic, in W.
+func NewEvePower() *EvePower {
+	c := characteristic.NewFloat(TypeEvePower)
+	c.Format = characteristic.FormatFloat
+	c.Permissions = []string{characteristic.PermissionRead, characteristic.PermissionEvents}
+	c.Description = "Power"
+	c.SetMinValue(0)
+	c.SetMaxValue(1000000)
+	c.SetStepValue(0.01)
+	c.SetValue(0)
+
+	return &EvePower{c}
+}
@@ -0,0 +1,21 @@
+package characteristic
+
+import (
+	"github.com/brutella/hap/characteristic"
+)
+
+const TypeEveSetTime = "E863F121-079E-48FF-8F27-9C2605A29F52"
+
+type EveSetTime struct {
+	*characteristic.Bytes
+}
+
+// NewEveSetTime creates the characteristic setting the time of the accessory (S2W2).
+func NewEveSetTime() *EveSetTime {
+	c := characteristic.NewBytes(TypeEveSetTime)
+	c.Format = characteristic.FormatData
+	c.Permissions = []string{characteristic.PermissionWrite, characteristic.PermissionHidden}
+	c.SetValue([]byte{})
+
+	return &EveSetTime{c}
+}
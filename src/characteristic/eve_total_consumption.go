@@ -0,0 +1,25 @@
+package characteristic
+
+import (
+	"github.com/brutella/hap/characteristic"
+)
+
+const TypeEveTotalConsumption = "E863F10C-079E-48FF-8F27-9C2605A29F52"
+
+type EveTotalConsumption struct {
+	*characteristic.Float
+}
+
+// NewEveTotalConsumption creates the total energy consumption characteristic, in kWh.
+func NewEveTotalConsumption() *EveTotalConsumption {
+	c := characteristic.NewFloat(TypeEveTotalConsumption)
+	c.Format = characteristic.FormatFloat
+	c.Permissions = []string{characteristic.PermissionRead, characteristic.PermissionEvents}
+	c.Description = "Total Consumption"
+	c.SetMinValue(0)
+	c.SetMaxValue(1000000)
+	c.SetStepValue(0.01)
+	c.SetValue(0)
+
+	return &EveTotalConsumption{c}
+}
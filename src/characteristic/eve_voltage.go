@@ -0,0 +1,25 @@
+package characteristic
+
+import (
+	"github.com/brutella/hap/characteristic"
+)
+
+const TypeEveVoltage = "E863F10A-079E-48FF-8F27-9C2605A29F52"
+
+type EveVoltage struct {
+	*characteristic.Float
+}
+
+// NewEveVoltage creates the voltage characteristic, in V.
+func NewEveVoltage() *EveVoltage {
+	c := characteristic.NewFloat(TypeEveVoltage)
+	c.Format = characteristic.FormatFloat
+	c.Permissions = []string{characteristic.PermissionRead, characteristic.PermissionEvents}
+	c.Description = "Voltage"
+	c.SetMinValue(0)
+	c.SetMaxValue(1000000)
+	c.SetStepValue(0.01)
+	c.SetValue(0)
+
+	return &EveVoltage{c}
+}
@@ -1,9 +1,209 @@
 package config
 
+import (
+	"bytes"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
 type Device struct {
 	Name         string   `yaml:"name"`
 	FriendlyName string   `yaml:"friendly_name"`
 	Options      []string `yaml:"options"`
+	Confirm      *Confirm `yaml:"confirm,omitempty"`
+
+	// Settings holds the remaining, driver specific fields.
+	Settings map[string]interface{} `yaml:",inline"`
+}
+
+// Decode strictly decodes the driver specific settings into out.
+func (d Device) Decode(out interface{}) error {
+	b, err := yaml.Marshal(d.Settings)
+	if err != nil {
+		return err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	return decoder.Decode(out)
+}
+
+// Confirm enables waiting for the device to echo the state of a command.
+type Confirm struct {
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	Retries int           `yaml:"retries,omitempty"`
+}
+
+// TasmotaPlugSettings selects the HomeKit service of a Tasmota plug:
+// lightbulb (default), outlet, switch or fan.
+type TasmotaPlugSettings struct {
+	Service string `yaml:"service,omitempty"`
+
+	// Energy exposes the ENERGY readings of the plug. An outlet is in use
+	// while it draws more than InUseThreshold watts.
+	Energy         bool    `yaml:"energy,omitempty"`
+	InUseThreshold float64 `yaml:"in_use_threshold,omitempty"`
+}
+
+// TasmotaClimateSensorSettings configures the measurements of a climate sensor.
+type TasmotaClimateSensorSettings struct {
+	CO2Threshold  float64       `yaml:"co2_threshold,omitempty"`   // Abnormal above, in ppm
+	CO2PeakWindow time.Duration `yaml:"co2_peak_window,omitempty"` // Peak level reset interval
+
+	// Sensors maps the measurements to expose (temperature, humidity, co2,
+	// light, pm25, pm10 and pressure) to the sensor block reporting them,
+	// e.g. SHT3X. An empty block selects the first block reporting it.
+	Sensors map[string]string `yaml:"sensors,omitempty"`
+
+	// Probes are exposed as additional temperature sensors.
+	Probes []TasmotaProbe `yaml:"probes,omitempty"`
+
+	// AirQuality lists the upper CO2 levels of excellent, good, fair and
+	// inferior air quality, poor above. Adds an air quality sensor.
+	AirQuality []float64 `yaml:"air_quality,omitempty"`
+}
+
+// TasmotaProbe selects a temperature probe by its sensor block, e.g.
+// DS18B20-1, or by the id it reports.
+type TasmotaProbe struct {
+	Block string `yaml:"block,omitempty"`
+	ID    string `yaml:"id,omitempty"`
+	Name  string `yaml:"name"`
+}
+
+// TasmotaRelaySettings lists the power outputs of a multi-relay Tasmota device.
+type TasmotaRelaySettings struct {
+	Channels []TasmotaRelayChannel `yaml:"channels"`
+}
+
+type TasmotaRelayChannel struct {
+	Output  string `yaml:"output"`            // e.g. POWER1
+	Name    string `yaml:"name,omitempty"`    // Defaults to the output
+	Service string `yaml:"service,omitempty"` // lightbulb (default), outlet, switch or fan
+}
+
+// ShellyRPCSettings lists the components of a Shelly Gen2/Gen3 device
+// controlled by JSON-RPC over MQTT.
+type ShellyRPCSettings struct {
+	Prefix     string               `yaml:"prefix,omitempty"` // MQTT topic prefix, defaults to the name
+	Components []ShellyRPCComponent `yaml:"components"`
+}
+
+type ShellyRPCComponent struct {
+	Type    string `yaml:"type"`              // switch, light, cover or input
+	ID      int    `yaml:"id"`                // Component id, e.g. 1 for switch:1
+	Name    string `yaml:"name,omitempty"`    // Defaults to the component key
+	Service string `yaml:"service,omitempty"` // Switch: lightbulb (default), outlet, switch or fan. Input: contact_sensor (default) or programmable_switch
+	Tilt    bool   `yaml:"tilt,omitempty"`    // Cover with slats
+}
+
+// ProgrammableSwitchSettings maps MQTT messages to the presses of the
+// buttons of a stateless programmable switch. Topics may contain "{name}",
+// which is replaced by the device name.
+type ProgrammableSwitchSettings struct {
+	Availability *GenericAvailability `yaml:"availability,omitempty"`
+	Buttons      []ProgrammableButton `yaml:"buttons"`
+}
+
+// ProgrammableButton lists the payloads of the presses of a button. Without
+// any, the Tasmota payloads SINGLE, DOUBLE and HOLD are used.
+type ProgrammableButton struct {
+	Name     string `yaml:"name,omitempty"`
+	Topic    string `yaml:"topic"`
+	JSONPath string `yaml:"json_path,omitempty"`
+	Single   string `yaml:"single,omitempty"`
+	Double   string `yaml:"double,omitempty"`
+	Long     string `yaml:"long,omitempty"`
+}
+
+// WindowCoveringSettings selects the device protocol of a window covering:
+// tasmota (shutter), shelly (cover component) or fhem (EnOcean shutter).
+type WindowCoveringSettings struct {
+	Protocol string `yaml:"protocol"`
+	ID       int    `yaml:"id,omitempty"`     // Tasmota shutter (default 1) or Shelly cover id (default 0)
+	Tilt     bool   `yaml:"tilt,omitempty"`   // Expose the tilt angle of the slats
+	Invert   bool   `yaml:"invert,omitempty"` // The device position is % closed
+}
+
+// ThermostatSettings references the devices a software thermostat
+// controls by their name.
+type ThermostatSettings struct {
+	Sensor     string        `yaml:"sensor"`               // Measures the temperature, e.g. a Tasmota climate sensor
+	Heater     string        `yaml:"heater"`               // Switches the heater, e.g. a Tasmota plug
+	Hysteresis float64       `yaml:"hysteresis,omitempty"` // Degrees around the target temperature
+	MinOnTime  time.Duration `yaml:"min_on_time,omitempty"`
+	MinOffTime time.Duration `yaml:"min_off_time,omitempty"`
+}
+
+// GenericSettings describes an accessory entirely in configuration.
+// Topics may contain "{name}", which is replaced by the device name.
+type GenericSettings struct {
+	Service         string                  `yaml:"service"`
+	Manufacturer    string                  `yaml:"manufacturer,omitempty"`
+	Availability    *GenericAvailability    `yaml:"availability,omitempty"`
+	StateRequest    *GenericStateRequest    `yaml:"state_request,omitempty"`
+	Characteristics []GenericCharacteristic `yaml:"characteristics"`
+}
+
+// GenericStateRequest is published on startup to make the device publish its state.
+type GenericStateRequest struct {
+	Topic   string `yaml:"topic"`
+	Payload string `yaml:"payload,omitempty"`
+}
+
+type GenericAvailability struct {
+	Topic          string `yaml:"topic"`
+	JSONPath       string `yaml:"json_path,omitempty"`
+	PayloadOffline string `yaml:"payload_offline,omitempty"`
+}
+
+type GenericCharacteristic struct {
+	Type            string             `yaml:"type"`
+	StateTopic      string             `yaml:"state_topic,omitempty"`
+	CommandTopic    string             `yaml:"command_topic,omitempty"`
+	JSONPath        string             `yaml:"json_path,omitempty"`
+	PayloadOn       string             `yaml:"payload_on,omitempty"`
+	PayloadOff      string             `yaml:"payload_off,omitempty"`
+	Values          map[string]float64 `yaml:"values,omitempty"`
+	CommandTemplate string             `yaml:"command_template,omitempty"`
+}
+
+// Zigbee2MQTT creates accessories for the devices published on
+// <base_topic>/bridge/devices.
+type Zigbee2MQTT struct {
+	Enabled   bool              `yaml:"enabled"`
+	BaseTopic string            `yaml:"base_topic,omitempty"` // Defaults to zigbee2mqtt
+	Include   []string          `yaml:"include,omitempty"`    // Friendly names or IEEE addresses, all devices when empty
+	Exclude   []string          `yaml:"exclude,omitempty"`
+	Names     map[string]string `yaml:"names,omitempty"` // Accessory names by friendly name or IEEE address
+}
+
+// Zigbee2MQTTSettings are the settings of a device discovered from
+// Zigbee2MQTT, which are not configured by hand.
+type Zigbee2MQTTSettings struct {
+	BaseTopic   string              `yaml:"base_topic"`
+	Device      string              `yaml:"device,omitempty"` // Friendly name in the topics, defaults to the name
+	IEEEAddress string              `yaml:"ieee_address"`
+	Vendor      string              `yaml:"vendor,omitempty"`
+	Model       string              `yaml:"model,omitempty"`
+	Exposes     []Zigbee2MQTTExpose `yaml:"exposes"`
+}
+
+// Zigbee2MQTTExpose is an exposes definition of a Zigbee2MQTT device, a
+// property (e.g. temperature) or a group of features (e.g. a light).
+type Zigbee2MQTTExpose struct {
+	Type     string              `yaml:"type" json:"type"`
+	Name     string              `yaml:"name,omitempty" json:"name"`
+	Property string              `yaml:"property,omitempty" json:"property"`
+	Endpoint string              `yaml:"endpoint,omitempty" json:"endpoint"`
+	Access   int                 `yaml:"access,omitempty" json:"access"` // Bits: published, settable, gettable
+	Unit     string              `yaml:"unit,omitempty" json:"unit"`
+	ValueOn  interface{}         `yaml:"value_on,omitempty" json:"value_on"`
+	ValueOff interface{}         `yaml:"value_off,omitempty" json:"value_off"`
+	ValueMin *float64            `yaml:"value_min,omitempty" json:"value_min"`
+	ValueMax *float64            `yaml:"value_max,omitempty" json:"value_max"`
+	Features []Zigbee2MQTTExpose `yaml:"features,omitempty" json:"features"`
 }
 
 type Config struct {
@@ -19,14 +219,29 @@ type Config struct {
 		Username string `yaml:"username"`
 		Password string `yaml:"password"`
 		ClientID string `yaml:"client_id"`
+
+		ConnectRetryInterval time.Duration `yaml:"connect_retry_interval"`
+		MaxReconnectInterval time.Duration `yaml:"max_reconnect_interval"`
+		PublishTimeout       time.Duration `yaml:"publish_timeout"`
+
+		// Availability of hap-mqtt itself, retained birth & last will
+		Availability struct {
+			Topic          string `yaml:"topic"`
+			PayloadOnline  string `yaml:"payload_online"`
+			PayloadOffline string `yaml:"payload_offline"`
+		} `yaml:"availability"`
+
+		TLS struct {
+			CAFile             string `yaml:"ca_file"`
+			CertFile           string `yaml:"cert_file"`
+			KeyFile            string `yaml:"key_file"`
+			ServerName         string `yaml:"server_name"`
+			InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+		} `yaml:"tls"`
 	} `yaml:"mqtt"`
 
-	Devices struct {
-		ContactSensors        []Device `yaml:"contact_sensors"`
-		EnOceanDimmers        []Device `yaml:"enocean_dimmers"`
-		EnOceanLightbulbs     []Device `yaml:"enocean_lightbulbs"`
-		ShellyDimmers         []Device `yaml:"shelly_dimmers"`
-		TasmotaClimateSensors []Device `yaml:"tasmota_climate_sensors"`
-		TasmotaPlugs          []Device `yaml:"tasmota_plugs"`
-	} `yaml:"devices"`
+	Zigbee2MQTT Zigbee2MQTT `yaml:"zigbee2mqtt"`
+
+	// Devices maps a registered driver key to its device configurations.
+	Devices map[string][]Device `yaml:"devices"`
 }
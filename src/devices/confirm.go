@@ -0,0 +1,105 @@
+package devices
+
+import (
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/charmbracelet/log"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+const defaultConfirmTimeout = 3 * time.Second
+
+// pendingCommand is a command awaiting the state echo of the device.
+type pendingCommand struct {
+	want   interface{}
+	result chan bool // true when confirmed, false when superseded by a newer command
+}
+
+// command publishes a command setting c to want. With confirm configured,
+// it waits for the device to report want and retries the command. When it
+// is never confirmed, c is reverted to the last reported value and the
+// device is marked as failed until it reports again.
+func (r *Reachability) command(client mqtt.Client, c *characteristic.C, want interface{}, topic string, payload string) {
+	if r.confirm == nil {
+		r.publish(client, topic, payload)
+		return
+	}
+
+	p := &pendingCommand{want: want, result: make(chan bool, 1)}
+	r.mu.Lock()
+	if old, ok := r.pending[c]; ok {
+		old.result <- false
+	}
+	r.pending[c] = p
+	r.mu.Unlock()
+
+	// The first attempt is published right away, so a write waits for it
+	token := r.send(client, topic, payload)
+	go r.confirmCommand(client, c, p, topic, payload, token)
+}
+
+func (r *Reachability) confirmCommand(client mqtt.Client, c *characteristic.C, p *pendingCommand, topic string, payload string, token mqtt.Token) {
+	timeout := r.confirm.Timeout
+	if timeout == 0 {
+		timeout = defaultConfirmTimeout
+	}
+
+	for attempt := 0; attempt <= r.confirm.Retries; attempt++ {
+		if attempt > 0 {
+			log.Warn("MQTT command not confirmed, retrying", "device", r.name, "topic", topic, "attempt", attempt)
+			token = client.Publish(topic, 1, false, payload)
+		}
+
+		<-token.Done()
+		if err := token.Error(); err != nil {
+			log.Error("MQTT publish failed", "device", r.name, "topic", topic, "error", err)
+		} else {
+			log.Debugf("MQTT published %s to %s", payload, topic)
+		}
+
+		timer := time.NewTimer(timeout)
+		select {
+		case confirmed := <-p.result:
+			timer.Stop()
+			if confirmed {
+				log.Debugf("MQTT %s confirmed %s", r.name, payload)
+			}
+			return
+		case <-timer.C:
+		}
+	}
+
+	r.mu.Lock()
+	if r.pending[c] != p {
+		// Confirmed or superseded meanwhile
+		r.mu.Unlock()
+		return
+	}
+	delete(r.pending, c)
+	last, ok := r.reported[c]
+	r.mu.Unlock()
+
+	log.Error("MQTT command not confirmed", "device", r.name, "topic", topic, "payload", payload)
+	r.failed.Store(true)
+	if ok {
+		c.SetValueRequest(last, nil)
+	}
+}
+
+// report sets c to the value reported by the device and confirms a
+// pending command expecting it.
+func (r *Reachability) report(c *characteristic.C, v interface{}) {
+	c.SetValueRequest(v, nil)
+	v = c.Value()
+
+	r.mu.Lock()
+	r.reported[c] = v
+	if p, ok := r.pending[c]; ok && p.want == v {
+		delete(r.pending, c)
+		p.result <- true
+	}
+	r.mu.Unlock()
+
+	r.failed.Store(false)
+}
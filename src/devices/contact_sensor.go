@@ -12,9 +12,24 @@ import (
 	"github.com/eclipse/paho.mqtt.golang"
 )
 
+func init() {
+	Register(Driver{
+		Key:         "contact_sensors",
+		Description: "Contact sensor with ON/OFF payload",
+		Options: []Option{
+			{Name: "topic", Description: "MQTT topic to listen on", Required: true},
+		},
+		Offset: 300,
+		New: func(id int, config config.Device) (Device, error) {
+			return NewContactSensor(id, config), nil
+		},
+	})
+}
+
 type ContactSensor struct {
 	*accessory.A
 	*service.ContactSensor
+	*Reachability
 	config config.Device
 }
 
@@ -38,6 +53,7 @@ func NewContactSensor(id int, config config.Device) *ContactSensor {
 	a.ContactSensorState.SetValue(characteristic.ContactSensorStateContactNotDetected)
 	a.AddS(a.ContactSensor.S)
 
+	a.Reachability = newReachability(a.A, config)
 	a.config = config
 
 	return &a
@@ -13,9 +13,22 @@ import (
 	"github.com/eclipse/paho.mqtt.golang"
 )
 
+func init() {
+	Register(Driver{
+		Key:         "enocean_dimmers",
+		Description: "EnOcean dimmer via FHEM",
+		Offset:      100,
+		Confirm:     true,
+		New: func(id int, config config.Device) (Device, error) {
+			return NewEnOceanDimmer(id, config), nil
+		},
+	})
+}
+
 type EnOceanDimmer struct {
 	*accessory.A
 	*service.DimmableLightbulb
+	*Reachability
 	config config.Device
 }
 
@@ -39,6 +52,7 @@ func NewEnOceanDimmer(id int, config config.Device) *EnOceanDimmer {
 	a.DimmableLightbulb = service.NewDimmableLightbulb()
 	a.AddS(a.DimmableLightbulb.S)
 
+	a.Reachability = newReachability(a.A, config)
 	a.config = config
 
 	return &a
@@ -56,9 +70,7 @@ func (a *EnOceanDimmer) Listen(client mqtt.Client) {
 		payload := string(msg.Payload())
 		log.Debugf("MQTT received %s from %s", payload, msg.Topic())
 
-		if strings.ToLower(payload) == "offline" {
-			log.Infof("MQTT %s is offline", a.config.Name)
-		}
+		a.SetOnline(strings.ToLower(payload) != "offline")
 	})
 
 	subDim := fmt.Sprintf("fhem/stat/%s/dim", a.config.Name)
@@ -67,7 +79,7 @@ func (a *EnOceanDimmer) Listen(client mqtt.Client) {
 		payload := string(msg.Payload())
 		log.Debugf("MQTT received %s from %s", payload, msg.Topic())
 		brightness, _ := strconv.Atoi(payload)
-		a.Brightness.SetValue(brightness)
+		a.report(a.Brightness.C, brightness)
 	})
 
 	subState := fmt.Sprintf("fhem/stat/%s/state", a.config.Name)
@@ -78,29 +90,31 @@ func (a *EnOceanDimmer) Listen(client mqtt.Client) {
 
 		switch strings.ToLower(payload) {
 		case "on":
-			a.On.SetValue(true)
+			a.report(a.On.C, true)
 		case "off":
-			a.On.SetValue(false)
+			a.report(a.On.C, false)
 		}
 	})
 
 	// HAP -> MQTT
 	pubDim := fmt.Sprintf("fhem/cmnd/%s/dim", a.config.Name)
-	a.Brightness.OnValueRemoteUpdate(func(brightness int) {
-		token := client.Publish(pubDim, 1, false, fmt.Sprintf("%d", brightness))
-		token.Wait()
-		log.Debugf("MQTT published %d to %s", brightness, pubDim)
+	onCommand(a.Reachability, a.Brightness.C, func(brightness int) {
+		a.command(client, a.Brightness.C, brightness, pubDim, fmt.Sprintf("%d", brightness))
 	})
 
 	pubState := fmt.Sprintf("fhem/cmnd/%s/state", a.config.Name)
-	a.On.OnValueRemoteUpdate(func(on bool) {
+	onCommand(a.Reachability, a.On.C, func(on bool) {
 		// Only publish "off" state. "On" state is implied by dim value.
 		// Otherwise the light briefly goes to 100% before going to the dim value.
 		if on == false {
 			payload := "off"
-			token := client.Publish(pubState, 1, false, payload)
-			token.Wait()
-			log.Debugf("MQTT published %s to %s", payload, pubState)
+			a.command(client, a.On.C, on, pubState, payload)
 		}
 	})
 }
+
+// RequestState asks FHEM to publish the current readings of the device.
+func (a *EnOceanDimmer) RequestState(client mqtt.Client) {
+	pubRequest := fmt.Sprintf("fhem/cmnd/%s/statusRequest", a.config.Name)
+	a.publish(client, pubRequest, "")
+}
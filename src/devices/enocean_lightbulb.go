@@ -12,9 +12,22 @@ import (
 	"github.com/eclipse/paho.mqtt.golang"
 )
 
+func init() {
+	Register(Driver{
+		Key:         "enocean_lightbulbs",
+		Description: "EnOcean switch via FHEM",
+		Offset:      400,
+		Confirm:     true,
+		New: func(id int, config config.Device) (Device, error) {
+			return NewEnOceanLightbulb(id, config), nil
+		},
+	})
+}
+
 type EnOceanLightbulb struct {
 	*accessory.A
 	*service.Lightbulb
+	*Reachability
 	config config.Device
 }
 
@@ -38,6 +51,7 @@ func NewEnOceanLightbulb(id int, config config.Device) *EnOceanLightbulb {
 	a.Lightbulb = service.NewLightbulb()
 	a.AddS(a.Lightbulb.S)
 
+	a.Reachability = newReachability(a.A, config)
 	a.config = config
 
 	return &a
@@ -55,9 +69,7 @@ func (a *EnOceanLightbulb) Listen(client mqtt.Client) {
 		payload := string(msg.Payload())
 		log.Debugf("MQTT received %s from %s", payload, msg.Topic())
 
-		if strings.ToLower(payload) == "offline" {
-			log.Infof("MQTT %s is offline", a.config.Name)
-		}
+		a.SetOnline(strings.ToLower(payload) != "offline")
 	})
 
 	subState := fmt.Sprintf("fhem/stat/%s/state", a.config.Name)
@@ -68,21 +80,25 @@ func (a *EnOceanLightbulb) Listen(client mqtt.Client) {
 
 		switch strings.ToLower(payload) {
 		case "on":
-			a.On.SetValue(true)
+			a.report(a.On.C, true)
 		case "off":
-			a.On.SetValue(false)
+			a.report(a.On.C, false)
 		}
 	})
 
 	// HAP -> MQTT
 	pubState := fmt.Sprintf("fhem/cmnd/%s/state", a.config.Name)
-	a.On.OnValueRemoteUpdate(func(on bool) {
+	onCommand(a.Reachability, a.On.C, func(on bool) {
 		payload := "off"
 		if on == true {
 			payload = "on"
 		}
-		token := client.Publish(pubState, 1, false, payload)
-		token.Wait()
-		log.Debugf("MQTT published %s to %s", payload, pubState)
+		a.command(client, a.On.C, on, pubState, payload)
 	})
 }
+
+// RequestState asks FHEM to publish the current readings of the device.
+func (a *EnOceanLightbulb) RequestState(client mqtt.Client) {
+	pubRequest := fmt.Sprintf("fhem/cmnd/%s/statusRequest", a.config.Name)
+	a.publish(client, pubRequest, "")
+}
@@ -0,0 +1,298 @@
+package devices
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"senhaerens.be/hap-mqtt/config"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/charmbracelet/log"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+func init() {
+	Register(Driver{
+		Key:         "generic",
+		Description: "Generic device described by its settings",
+		Confirm:     true,
+		Settings: func() interface{} {
+			return &config.GenericSettings{}
+		},
+		New: func(id int, config config.Device) (Device, error) {
+			return NewGenericDevice(id, config)
+		},
+	})
+}
+
+type genericService struct {
+	category byte
+	new      func() *service.S
+}
+
+var genericServices = map[string]genericService{
+	"air_quality_sensor":    {accessory.TypeSensor, func() *service.S { return service.NewAirQualitySensor().S }},
+	"carbon_dioxide_sensor": {accessory.TypeSensor, func() *service.S { return service.NewCarbonDioxideSensor().S }},
+	"contact_sensor":        {accessory.TypeSensor, func() *service.S { return service.NewContactSensor().S }},
+	"fan":                   {accessory.TypeFan, func() *service.S { return service.NewFan().S }},
+	"humidity_sensor":       {accessory.TypeSensor, func() *service.S { return service.NewHumiditySensor().S }},
+	"leak_sensor":           {accessory.TypeSensor, func() *service.S { return service.NewLeakSensor().S }},
+	"light_sensor":          {accessory.TypeSensor, func() *service.S { return service.NewLightSensor().S }},
+	"lightbulb":             {accessory.TypeLightbulb, func() *service.S { return service.NewLightbulb().S }},
+	"motion_sensor":         {accessory.TypeSensor, func() *service.S { return service.NewMotionSensor().S }},
+	"occupancy_sensor":      {accessory.TypeSensor, func() *service.S { return service.NewOccupancySensor().S }},
+	"outlet":                {accessory.TypeOutlet, func() *service.S { return service.NewOutlet().S }},
+	"smoke_sensor":          {accessory.TypeSensor, func() *service.S { return service.NewSmokeSensor().S }},
+	"switch":                {accessory.TypeSwitch, func() *service.S { return service.NewSwitch().S }},
+	"temperature_sensor":    {accessory.TypeSensor, func() *service.S { return service.NewTemperatureSensor().S }},
+}
+
+var genericCharacteristics = map[string]func() *characteristic.C{
+	"air_quality":                 func() *characteristic.C { return characteristic.NewAirQuality().C },
+	"brightness":                  func() *characteristic.C { return characteristic.NewBrightness().C },
+	"carbon_dioxide_detected":     func() *characteristic.C { return characteristic.NewCarbonDioxideDetected().C },
+	"carbon_dioxide_level":        func() *characteristic.C { return characteristic.NewCarbonDioxideLevel().C },
+	"color_temperature":           func() *characteristic.C { return characteristic.NewColorTemperature().C },
+	"contact_sensor_state":        func() *characteristic.C { return characteristic.NewContactSensorState().C },
+	"current_ambient_light_level": func() *characteristic.C { return characteristic.NewCurrentAmbientLightLevel().C },
+	"current_relative_humidity":   func() *characteristic.C { return characteristic.NewCurrentRelativeHumidity().C },
+	"current_temperature":         func() *characteristic.C { return characteristic.NewCurrentTemperature().C },
+	"hue":                         func() *characteristic.C { return characteristic.NewHue().C },
+	"leak_detected":               func() *characteristic.C { return characteristic.NewLeakDetected().C },
+	"motion_detected":             func() *characteristic.C { return characteristic.NewMotionDetected().C },
+	"occupancy_detected":          func() *characteristic.C { return characteristic.NewOccupancyDetected().C },
+	"on":                          func() *characteristic.C { return characteristic.NewOn().C },
+	"outlet_in_use":               func() *characteristic.C { return characteristic.NewOutletInUse().C },
+	"rotation_speed":              func() *characteristic.C { return characteristic.NewRotationSpeed().C },
+	"saturation":                  func() *characteristic.C { return characteristic.NewSaturation().C },
+	"smoke_detected":              func() *characteristic.C { return characteristic.NewSmokeDetected().C },
+	"status_low_battery":          func() *characteristic.C { return characteristic.NewStatusLowBattery().C },
+}
+
+type genericCharacteristic struct {
+	*characteristic.C
+	config config.GenericCharacteristic
+}
+
+type GenericDevice struct {
+	*accessory.A
+	Service *service.S
+	*Reachability
+	characteristics []*genericCharacteristic
+	settings        config.GenericSettings
+	config          config.Device
+}
+
+func NewGenericDevice(id int, cfg config.Device) (*GenericDevice, error) {
+	var settings config.GenericSettings
+	if err := cfg.Decode(&settings); err != nil {
+		return nil, err
+	}
+
+	name := cfg.Name
+	model := "Generic"
+	if cfg.FriendlyName != "" {
+		name = cfg.FriendlyName
+		model = fmt.Sprintf("%s (%s)", model, cfg.Name)
+	}
+
+	gs, ok := genericServices[settings.Service]
+	if !ok {
+		return nil, fmt.Errorf("unknown generic service %q", settings.Service)
+	}
+
+	a := GenericDevice{}
+	a.A = accessory.New(accessory.Info{
+		Name:         name,
+		Model:        model,
+		Manufacturer: settings.Manufacturer,
+	}, gs.category)
+	a.Id = uint64(id)
+	log.Infof("HAP Create Accessory %4d - %s", a.Id, cfg.Name)
+
+	a.Service = gs.new()
+	for _, cc := range settings.Characteristics {
+		newC, ok := genericCharacteristics[cc.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown generic characteristic %q", cc.Type)
+		}
+		// Commands are mapped back to a payload, which must be unambiguous
+		if cc.CommandTopic != "" {
+			payloads := map[float64]string{}
+			for _, k := range slices.Sorted(maps.Keys(cc.Values)) {
+				if other, ok := payloads[cc.Values[k]]; ok {
+					return nil, fmt.Errorf("values %q and %q of %q map to the same value", other, k, cc.Type)
+				}
+				payloads[cc.Values[k]] = k
+			}
+		}
+
+		// Reuse the characteristic when the service already provides it
+		c := newC()
+		if existing := a.Service.C(c.Type); existing != nil {
+			c = existing
+		} else {
+			a.Service.AddC(c)
+		}
+
+		a.characteristics = append(a.characteristics, &genericCharacteristic{C: c, config: cc})
+	}
+	a.AddS(a.Service)
+
+	a.Reachability = newReachability(a.A, cfg)
+	a.settings = settings
+	a.config = cfg
+
+	return &a, nil
+}
+
+func (a *GenericDevice) Accessory() *accessory.A {
+	return a.A
+}
+
+func (a *GenericDevice) topic(t string) string {
+	return strings.ReplaceAll(t, "{name}", a.config.Name)
+}
+
+func (a *GenericDevice) Listen(client mqtt.Client) {
+	// MQTT -> HAP
+	if avail := a.settings.Availability; avail != nil && avail.Topic != "" {
+		a.listenAvailability(client, a.topic(avail.Topic), avail)
+	}
+
+	for _, gc := range a.characteristics {
+		if gc.config.StateTopic != "" {
+			subState := a.topic(gc.config.StateTopic)
+			client.Subscribe(subState, 1, func(_ mqtt.Client, msg mqtt.Message) {
+				msg.Ack()
+				log.Debugf("MQTT received %s from %s", msg.Payload(), msg.Topic())
+
+				v, err := gc.decode(msg.Payload())
+				if err != nil {
+					log.Error("Failed to decode payload", "device", a.config.Name, "characteristic", gc.config.Type, "err", err)
+					return
+				}
+				a.report(gc.C, v)
+			})
+		}
+
+		// HAP -> MQTT
+		if gc.config.CommandTopic != "" {
+			pubCommand := a.topic(gc.config.CommandTopic)
+			onCommand(a.Reachability, gc.C, func(new interface{}) {
+				payload := gc.encode(new)
+				if gc.config.StateTopic == "" {
+					// Nothing to confirm the command with
+					a.publish(client, pubCommand, payload)
+					return
+				}
+				a.command(client, gc.C, new, pubCommand, payload)
+			})
+		}
+	}
+}
+
+func (a *GenericDevice) RequestState(client mqtt.Client) {
+	req := a.settings.StateRequest
+	if req == nil || req.Topic == "" {
+		return
+	}
+
+	pubRequest := a.topic(req.Topic)
+	a.publish(client, pubRequest, req.Payload)
+}
+
+func (gc *genericCharacteristic) payloadOn() string {
+	if gc.config.PayloadOn != "" {
+		return gc.config.PayloadOn
+	}
+	return "ON"
+}
+
+func (gc *genericCharacteristic) payloadOff() string {
+	if gc.config.PayloadOff != "" {
+		return gc.config.PayloadOff
+	}
+	return "OFF"
+}
+
+// decode converts an MQTT payload to a characteristic value.
+func (gc *genericCharacteristic) decode(payload []byte) (interface{}, error) {
+	var raw interface{} = string(payload)
+	if gc.config.JSONPath != "" {
+		v, err := lookupJSON(payload, gc.config.JSONPath)
+		if err != nil {
+			return nil, err
+		}
+		raw = v
+	}
+	text := strings.TrimSpace(fmt.Sprint(raw))
+
+	if len(gc.config.Values) > 0 {
+		for k, v := range gc.config.Values {
+			if strings.EqualFold(k, text) {
+				return v, nil
+			}
+		}
+		return nil, fmt.Errorf("unmapped value %q", text)
+	}
+
+	switch gc.Format {
+	case characteristic.FormatBool:
+		if b, ok := raw.(bool); ok {
+			return b, nil
+		}
+		switch {
+		case strings.EqualFold(text, gc.payloadOn()):
+			return true, nil
+		case strings.EqualFold(text, gc.payloadOff()):
+			return false, nil
+		}
+		return nil, fmt.Errorf("unknown boolean value %q", text)
+	case characteristic.FormatString:
+		return text, nil
+	default:
+		if f, ok := raw.(float64); ok {
+			return f, nil
+		}
+		return strconv.ParseFloat(text, 64)
+	}
+}
+
+// encode converts a characteristic value to an MQTT payload.
+func (gc *genericCharacteristic) encode(v interface{}) string {
+	var payload string
+	switch val := v.(type) {
+	case bool:
+		payload = gc.payloadOff()
+		if val {
+			payload = gc.payloadOn()
+		}
+	case int:
+		payload = strconv.Itoa(val)
+	case float64:
+		payload = strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		payload = fmt.Sprint(val)
+	}
+
+	if f, err := strconv.ParseFloat(payload, 64); err == nil {
+		for k, mapped := range gc.config.Values {
+			if mapped == f {
+				payload = k
+				break
+			}
+		}
+	}
+
+	if gc.config.CommandTemplate != "" {
+		payload = strings.ReplaceAll(gc.config.CommandTemplate, "{value}", payload)
+	}
+
+	return payload
+}
@@ -0,0 +1,311 @@
+package devices
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"senhaerens.be/hap-mqtt/service"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	historySize     = 4032             // Entries kept, 4 weeks at the history interval
+	historyInterval = 10 * time.Minute // Samples are averaged per interval, as the Eve app expects
+	historyChunk    = 11               // Entries served per read
+	historyStateKey = "history"
+
+	eveEpoch = 978307200 // 2001-01-01, the Eve time reference
+)
+
+// historyKind describes the samples of a history in the Eve (FakeGato)
+// protocol: the signature announced in the status and the entry layout.
+type historyKind struct {
+	signature string
+	values    int
+	encode    func(b []byte, values []float64) []byte
+}
+
+var (
+	// Temperature, humidity and pressure
+	historyWeather = historyKind{
+		signature: "03 0102 0202 0302",
+		values:    2,
+		encode: func(b []byte, v []float64) []byte {
+			b = append(b, 0x07)
+			b = appendInt16(b, v[0]*100)
+			b = appendInt16(b, v[1]*100)
+			return appendInt16(b, 0)
+		},
+	}
+	// Temperature, humidity and CO2
+	historyRoom = historyKind{
+		signature: "04 0102 0202 0402 0f03",
+		values:    3,
+		encode: func(b []byte, v []float64) []byte {
+			b = append(b, 0x0f)
+			b = appendInt16(b, v[0]*100)
+			b = appendInt16(b, v[1]*100)
+			b = appendInt16(b, v[2])
+			return append(b, 0, 0, 0)
+		},
+	}
+	// Power
+	historyEnergy = historyKind{
+		signature: "04 0102 0202 0702 0f03",
+		values:    1,
+		encode: func(b []byte, v []float64) []byte {
+			b = append(b, 0x1f, 0, 0, 0, 0)
+			b = appendInt16(b, v[0]*10)
+			return append(b, 0, 0, 0, 0)
+		},
+	}
+)
+
+// historyEntry is a sample, or the reference entry when Values is nil.
+type historyEntry struct {
+	Time   uint32    `json:"t"` // Seconds since the Eve epoch
+	Values []float64 `json:"v,omitempty"`
+}
+
+// historyData is the persisted ring buffer, entry n is stored at (n-1) % historySize.
+type historyData struct {
+	RefTime uint32         `json:"ref_time"`
+	Last    uint32         `json:"last"`
+	Entries []historyEntry `json:"entries"`
+}
+
+// History records the averaged samples of a device and serves them to the
+// Eve app, which draws graphs from them.
+type History struct {
+	*service.EveHistory
+	kind historyKind
+
+	mu      sync.Mutex
+	data    historyData
+	state   StateStore
+	window  time.Time // Start of the interval being averaged
+	sums    []float64
+	samples int
+	next    uint32 // Next entry requested by the Eve app, 0 when not transferring
+}
+
+func newHistory(kind historyKind) *History {
+	h := &History{
+		EveHistory: service.NewEveHistory(),
+		kind:       kind,
+	}
+
+	h.Status.ValueRequestFunc = func(req *http.Request) (interface{}, int) {
+		if req == nil {
+			return h.Status.C.Value(), 0
+		}
+		return h.status(), 0
+	}
+
+	h.Entries.ValueRequestFunc = func(req *http.Request) (interface{}, int) {
+		// Reading advances the transfer, but not when describing the accessory
+		if req == nil {
+			return h.Entries.C.Value(), 0
+		}
+		return h.entries(), 0
+	}
+
+	h.Request.OnValueUpdate(func(new, _ []byte, req *http.Request) {
+		if req == nil {
+			return
+		}
+		h.request(new)
+		// Reset so the same request is handled again
+		h.Request.SetValue([]byte{})
+	})
+
+	h.SetTime.OnValueUpdate(func(new, _ []byte, req *http.Request) {
+		if req == nil {
+			return
+		}
+		log.Debugf("HAP Eve history time set to %x", new)
+		h.SetTime.SetValue([]byte{})
+	})
+
+	return h
+}
+
+// restore loads the recorded history from the accessory state.
+func (h *History) restore(store StateStore) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.state = store
+	var data historyData
+	if !store.Get(historyStateKey, &data) || len(data.Entries) > historySize || int(data.Last) < len(data.Entries) {
+		return
+	}
+	// Drop a history recorded with other samples, e.g. after enabling CO2
+	for _, e := range data.Entries {
+		if e.Values != nil && len(e.Values) != h.kind.values {
+			log.Warn("Dropping Eve history with other samples", "entries", len(data.Entries))
+			return
+		}
+	}
+	h.data = data
+}
+
+// add records a sample, which is averaged with the other samples of its
+// interval. An interval is added as an entry once it has passed.
+func (h *History) add(values ...float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	window := now.Truncate(historyInterval)
+	if !window.Equal(h.window) {
+		if h.samples > 0 {
+			avg := make([]float64, len(h.sums))
+			for i, sum := range h.sums {
+				avg[i] = sum / float64(h.samples)
+			}
+			h.append(h.window.Add(historyInterval), avg)
+		}
+		h.window = window
+		h.sums = make([]float64, len(values))
+		h.samples = 0
+	}
+
+	for i, v := range values {
+		h.sums[i] += v
+	}
+	h.samples++
+}
+
+func (h *History) append(t time.Time, values []float64) {
+	eveTime := uint32(t.Unix() - eveEpoch)
+
+	// The first entry is the reference for the times of later entries
+	if h.data.Last == 0 {
+		h.data.RefTime = eveTime
+		h.put(historyEntry{Time: eveTime})
+	}
+	h.put(historyEntry{Time: eveTime, Values: values})
+
+	if h.state != nil {
+		h.state.Set(historyStateKey, h.data)
+	}
+}
+
+func (h *History) put(e historyEntry) {
+	h.data.Last++
+	if len(h.data.Entries) < historySize {
+		h.data.Entries = append(h.data.Entries, e)
+		return
+	}
+	h.data.Entries[(h.data.Last-1)%historySize] = e
+}
+
+// first returns the number of the oldest entry.
+func (h *History) first() uint32 {
+	return h.data.Last - uint32(len(h.data.Entries)) + 1
+}
+
+func (h *History) entry(n uint32) historyEntry {
+	return h.data.Entries[(n-1)%historySize]
+}
+
+// status encodes the history status (S2R1).
+func (h *History) status() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var lastTime uint32
+	if h.data.Last > 0 {
+		lastTime = h.entry(h.data.Last).Time - h.data.RefTime
+	}
+
+	var b []byte
+	b = binary.LittleEndian.AppendUint32(b, lastTime)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, h.data.RefTime)
+	signature, _ := hex.DecodeString(strings.ReplaceAll(h.kind.signature, " ", ""))
+	b = append(b, signature...)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(h.data.Entries)))
+	b = binary.LittleEndian.AppendUint16(b, historySize)
+	b = binary.LittleEndian.AppendUint32(b, h.data.Last-uint32(len(h.data.Entries)))
+	b = append(b, 0, 0, 0, 0, 0x01, 0x01)
+
+	return base64String(b)
+}
+
+// request starts a transfer from the entry requested by the Eve app (S2W1).
+func (h *History) request(b []byte) {
+	if len(b) < 6 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.next = max(binary.LittleEndian.Uint32(b[2:6]), 1)
+	log.Debugf("HAP Eve history requested from entry %d of %d", h.next, h.data.Last)
+}
+
+// entries encodes the next entries of a transfer (S2R2).
+func (h *History) entries() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.next == 0 || h.next > h.data.Last {
+		h.next = 0
+		return base64String([]byte{0})
+	}
+
+	// Entries overwritten meanwhile continue at the oldest entry
+	first := h.first()
+	h.next = max(h.next, first)
+
+	var b []byte
+	for i := 0; i < historyChunk && h.next <= h.data.Last; i++ {
+		e := h.entry(h.next)
+		// The oldest entry always serves as reference
+		if e.Values == nil || h.next == first {
+			b = h.appendReference(b, h.next)
+		} else {
+			b = h.appendEntry(b, h.next, e)
+		}
+		h.next++
+	}
+
+	return base64String(b)
+}
+
+func (h *History) appendReference(b []byte, n uint32) []byte {
+	b = append(b, 0x15)
+	b = binary.LittleEndian.AppendUint32(b, n)
+	b = append(b, 0x01, 0, 0, 0, 0x81)
+	b = binary.LittleEndian.AppendUint32(b, h.data.RefTime)
+	return append(b, 0, 0, 0, 0, 0, 0, 0)
+}
+
+func (h *History) appendEntry(b []byte, n uint32, e historyEntry) []byte {
+	start := len(b)
+	b = append(b, 0) // Length, set below
+	b = binary.LittleEndian.AppendUint32(b, n)
+	b = binary.LittleEndian.AppendUint32(b, e.Time-h.data.RefTime)
+	b = h.kind.encode(b, e.Values)
+	b[start] = byte(len(b) - start)
+	return b
+}
+
+func appendInt16(b []byte, v float64) []byte {
+	v = math.Max(math.MinInt16, math.Min(math.MaxInt16, math.Round(v)))
+	return binary.LittleEndian.AppendUint16(b, uint16(int16(v)))
+}
+
+func base64String(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
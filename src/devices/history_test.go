@@ -0,0 +1,211 @@
+package devices
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryKindEncode(t *testing.T) {
+	tests := []struct {
+		name   string
+		kind   historyKind
+		values []float64
+		want   string
+	}{
+		{name: "weather", kind: historyWeather, values: []float64{21.5, 55}, want: "07 6608 7c15 0000"},
+		{name: "weather negative", kind: historyWeather, values: []float64{-2.345, 0}, want: "07 15ff 0000 0000"},
+		{name: "weather clamped", kind: historyWeather, values: []float64{400, -400}, want: "07 ff7f 0080 0000"},
+		{name: "room", kind: historyRoom, values: []float64{20, 40.2, 812}, want: "0f d007 b40f 2c03 000000"},
+		{name: "energy", kind: historyEnergy, values: []float64{123.44}, want: "1f 00000000 d204 00000000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.values) != tt.kind.values {
+				t.Fatalf("%d values, the kind has %d", len(tt.values), tt.kind.values)
+			}
+			got := hex.EncodeToString(tt.kind.encode(nil, tt.values))
+			if want := hexString(tt.want); got != want {
+				t.Errorf("encode(%v) = %s, want %s", tt.values, got, want)
+			}
+		})
+	}
+}
+
+func TestHistoryStatus(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ref := uint32(start.Unix() - eveEpoch)
+
+	tests := []struct {
+		name      string
+		samples   int
+		lastTime  uint32
+		refTime   uint32
+		entries   uint16
+		overwrote uint32
+	}{
+		{name: "empty"},
+		{name: "recording", samples: 3, lastTime: 1200, refTime: ref, entries: 4},
+		{name: "full", samples: historySize + 2, lastTime: uint32(historySize+1) * 600, refTime: ref, entries: historySize, overwrote: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := recordedHistory(start, tt.samples)
+			b := decodeBase64(t, h.status())
+
+			if len(b) != 33 {
+				t.Fatalf("status has %d bytes, want 33", len(b))
+			}
+			if got := binary.LittleEndian.Uint32(b[0:4]); got != tt.lastTime {
+				t.Errorf("last time = %d, want %d", got, tt.lastTime)
+			}
+			if got := binary.LittleEndian.Uint32(b[8:12]); got != tt.refTime {
+				t.Errorf("reference time = %d, want %d", got, tt.refTime)
+			}
+			if got, want := hex.EncodeToString(b[12:19]), hexString(historyWeather.signature); got != want {
+				t.Errorf("signature = %s, want %s", got, want)
+			}
+			if got := binary.LittleEndian.Uint16(b[19:21]); got != tt.entries {
+				t.Errorf("entries = %d, want %d", got, tt.entries)
+			}
+			if got := binary.LittleEndian.Uint16(b[21:23]); got != historySize {
+				t.Errorf("size = %d, want %d", got, historySize)
+			}
+			if got := binary.LittleEndian.Uint32(b[23:27]); got != tt.overwrote {
+				t.Errorf("overwritten entries = %d, want %d", got, tt.overwrote)
+			}
+		})
+	}
+}
+
+func TestHistoryEntries(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		samples    int
+		from       uint32
+		reads      [][]uint32 // Entry numbers served per read
+		references []uint32
+	}{
+		{
+			name:  "empty",
+			from:  1,
+			reads: [][]uint32{nil},
+		},
+		{
+			name:       "all",
+			samples:    3,
+			from:       1,
+			reads:      [][]uint32{{1, 2, 3, 4}, nil},
+			references: []uint32{1},
+		},
+		{
+			name:    "from an entry",
+			samples: 3,
+			from:    3,
+			reads:   [][]uint32{{3, 4}, nil},
+		},
+		{
+			name:       "from zero",
+			samples:    1,
+			from:       0,
+			reads:      [][]uint32{{1, 2}, nil},
+			references: []uint32{1},
+		},
+		{
+			name:       "chunked",
+			samples:    20,
+			from:       1,
+			reads:      [][]uint32{{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, {12, 13, 14, 15, 16, 17, 18, 19, 20, 21}, nil},
+			references: []uint32{1},
+		},
+		{
+			name:    "past the last entry",
+			samples: 3,
+			from:    5,
+			reads:   [][]uint32{nil},
+		},
+		{
+			name:       "overwritten",
+			samples:    historySize + 2,
+			from:       2,
+			reads:      [][]uint32{{4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14}},
+			references: []uint32{4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := recordedHistory(start, tt.samples)
+			h.request(binary.LittleEndian.AppendUint32([]byte{0x01, 0x14}, tt.from))
+
+			var references []uint32
+			for i, want := range tt.reads {
+				got, refs := parseEntries(t, decodeBase64(t, h.entries()))
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("read %d served entries %v, want %v", i, got, want)
+				}
+				references = append(references, refs...)
+			}
+			if !reflect.DeepEqual(references, tt.references) {
+				t.Errorf("references %v, want %v", references, tt.references)
+			}
+		})
+	}
+}
+
+// recordedHistory returns a weather history with a sample per interval.
+func recordedHistory(start time.Time, samples int) *History {
+	h := newHistory(historyWeather)
+	for i := range samples {
+		h.append(start.Add(time.Duration(i)*historyInterval), []float64{20, 50})
+	}
+	return h
+}
+
+// parseEntries returns the numbers of the entries and of the reference
+// entries in a read, which is a single 0 byte when there are none.
+func parseEntries(t *testing.T, b []byte) (numbers, references []uint32) {
+	t.Helper()
+
+	if len(b) == 1 && b[0] == 0 {
+		return nil, nil
+	}
+	for len(b) > 0 {
+		size := int(b[0])
+		if size < 5 || size > len(b) {
+			t.Fatalf("invalid entry size %d with %d bytes left", size, len(b))
+		}
+		n := binary.LittleEndian.Uint32(b[1:5])
+		numbers = append(numbers, n)
+		if size == 0x15 {
+			references = append(references, n)
+		} else if size != 16 {
+			t.Errorf("entry %d has %d bytes, want 16", n, size)
+		}
+		b = b[size:]
+	}
+
+	return numbers, references
+}
+
+func decodeBase64(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func hexString(s string) string {
+	return strings.ReplaceAll(s, " ", "")
+}
@@ -0,0 +1,43 @@
+package devices
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// lookupJSON decodes data and returns the value at the dotted path,
+// e.g. "ENERGY.Power" or "StatusSNS.DS18B20.0.Temperature".
+// An empty path returns the whole document.
+func lookupJSON(data []byte, path string) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		return v, nil
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				return nil, fmt.Errorf("key %q not found in %q", key, path)
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, fmt.Errorf("index %q out of range in %q", key, path)
+			}
+			v = node[i]
+		default:
+			return nil, fmt.Errorf("key %q is not an object in %q", key, path)
+		}
+	}
+
+	return v, nil
+}
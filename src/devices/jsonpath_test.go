@@ -0,0 +1,142 @@
+package devices
+
+import (
+	"reflect"
+	"testing"
+
+	"senhaerens.be/hap-mqtt/config"
+
+	"github.com/brutella/hap/characteristic"
+)
+
+func TestLookupJSON(t *testing.T) {
+	const doc = `{"ENERGY":{"Power":12.5},"StatusSNS":{"DS18B20":[{"Temperature":21.3}]},"POWER":"ON"}`
+
+	tests := []struct {
+		path    string
+		want    interface{}
+		wantErr bool
+	}{
+		{path: "ENERGY.Power", want: 12.5},
+		{path: "StatusSNS.DS18B20.0.Temperature", want: 21.3},
+		{path: "POWER", want: "ON"},
+		{path: "ENERGY", want: map[string]interface{}{"Power": 12.5}},
+		{path: "ENERGY.Voltage", wantErr: true},
+		{path: "StatusSNS.DS18B20.1.Temperature", wantErr: true},
+		{path: "StatusSNS.DS18B20.first", wantErr: true},
+		{path: "POWER.State", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := lookupJSON([]byte(doc), tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lookupJSON(%q) error = %v, want error %v", tt.path, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lookupJSON(%q) = %#v, want %#v", tt.path, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := lookupJSON([]byte("ON"), "POWER"); err == nil {
+		t.Error("lookupJSON of a plain payload succeeded")
+	}
+}
+
+func TestGenericCharacteristicDecode(t *testing.T) {
+	on := characteristic.NewOn().C
+	temperature := characteristic.NewCurrentTemperature().C
+	name := characteristic.NewName().C
+
+	tests := []struct {
+		name    string
+		c       *characteristic.C
+		config  config.GenericCharacteristic
+		payload string
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "bool default payload", c: on, payload: "on", want: true},
+		{name: "bool custom payload", c: on, config: config.GenericCharacteristic{PayloadOn: "1", PayloadOff: "0"}, payload: "0", want: false},
+		{name: "bool unknown payload", c: on, payload: "toggle", wantErr: true},
+		{name: "bool JSON", c: on, config: config.GenericCharacteristic{JSONPath: "state"}, payload: `{"state":true}`, want: true},
+		{name: "number", c: temperature, payload: " 21.5\n", want: 21.5},
+		{name: "number JSON", c: temperature, config: config.GenericCharacteristic{JSONPath: "ENERGY.Power"}, payload: `{"ENERGY":{"Power":7}}`, want: 7.0},
+		{name: "number JSON missing", c: temperature, config: config.GenericCharacteristic{JSONPath: "ENERGY.Power"}, payload: `{}`, wantErr: true},
+		{name: "number invalid", c: temperature, payload: "warm", wantErr: true},
+		{name: "mapped value", c: temperature, config: config.GenericCharacteristic{Values: map[string]float64{"open": 1, "closed": 0}}, payload: "Open", want: 1.0},
+		{name: "unmapped value", c: temperature, config: config.GenericCharacteristic{Values: map[string]float64{"open": 1}}, payload: "ajar", wantErr: true},
+		{name: "string", c: name, payload: "Kitchen ", want: "Kitchen"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gc := &genericCharacteristic{C: tt.c, config: tt.config}
+			got, err := gc.decode([]byte(tt.payload))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decode(%q) error = %v, want error %v", tt.payload, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("decode(%q) = %#v, want %#v", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenericCharacteristicEncode(t *testing.T) {
+	tests := []struct {
+		name   string
+		config config.GenericCharacteristic
+		value  interface{}
+		want   string
+	}{
+		{name: "bool default payload", value: true, want: "ON"},
+		{name: "bool custom payload", config: config.GenericCharacteristic{PayloadOn: "1", PayloadOff: "0"}, value: false, want: "0"},
+		{name: "int", value: 42, want: "42"},
+		{name: "float", value: 21.5, want: "21.5"},
+		{name: "string", value: "auto", want: "auto"},
+		{name: "mapped value", config: config.GenericCharacteristic{Values: map[string]float64{"open": 1, "closed": 0}}, value: 1, want: "open"},
+		{name: "unmapped value", config: config.GenericCharacteristic{Values: map[string]float64{"open": 1}}, value: 2, want: "2"},
+		{name: "template", config: config.GenericCharacteristic{CommandTemplate: `{"brightness":{value}}`}, value: 80, want: `{"brightness":80}`},
+		{name: "mapped value in template", config: config.GenericCharacteristic{Values: map[string]float64{"open": 1}, CommandTemplate: `{"state":"{value}"}`}, value: 1, want: `{"state":"open"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gc := &genericCharacteristic{C: characteristic.NewOn().C, config: tt.config}
+			if got := gc.encode(tt.value); got != tt.want {
+				t.Errorf("encode(%#v) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewGenericDeviceValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  map[string]interface{}
+		command string
+		wantErr bool
+	}{
+		{name: "distinct values", values: map[string]interface{}{"open": 1, "closed": 0}, command: "cmnd/{name}/state"},
+		{name: "same value without commands", values: map[string]interface{}{"open": 1, "ajar": 1}},
+		{name: "same value with commands", values: map[string]interface{}{"open": 1, "ajar": 1}, command: "cmnd/{name}/state", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := map[string]interface{}{"type": "contact_sensor_state", "values": tt.values}
+			if tt.command != "" {
+				c["command_topic"] = tt.command
+			}
+			_, err := NewGenericDevice(2, config.Device{
+				Name:     "sensor",
+				Settings: map[string]interface{}{"service": "contact_sensor", "characteristics": []interface{}{c}},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewGenericDevice error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"senhaerens.be/hap-mqtt/config"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/charmbracelet/log"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+func init() {
+	Register(Driver{
+		Key:         "programmable_switches",
+		Description: "Stateless programmable switch triggered by MQTT messages",
+		Settings: func() interface{} {
+			return &config.ProgrammableSwitchSettings{}
+		},
+		New: func(id int, config config.Device) (Device, error) {
+			return NewProgrammableSwitch(id, config)
+		},
+	})
+}
+
+type programmableButton struct {
+	*service.StatelessProgrammableSwitch
+	events map[string]int // Press event by payload
+	config config.ProgrammableButton
+}
+
+func newProgrammableButton(cfg config.ProgrammableButton, index int) (*programmableButton, error) {
+	if cfg.Topic == "" {
+		return nil, errors.New("topic is missing")
+	}
+
+	payloads := map[int]string{
+		characteristic.ProgrammableSwitchEventSinglePress: cfg.Single,
+		characteristic.ProgrammableSwitchEventDoublePress: cfg.Double,
+		characteristic.ProgrammableSwitchEventLongPress:   cfg.Long,
+	}
+	if cfg.Single == "" && cfg.Double == "" && cfg.Long == "" {
+		payloads = map[int]string{
+			characteristic.ProgrammableSwitchEventSinglePress: "SINGLE",
+			characteristic.ProgrammableSwitchEventDoublePress: "DOUBLE",
+			characteristic.ProgrammableSwitchEventLongPress:   "HOLD",
+		}
+	}
+
+	b := &programmableButton{
+		StatelessProgrammableSwitch: service.NewStatelessProgrammableSwitch(),
+		events:                      map[string]int{},
+		config:                      cfg,
+	}
+
+	// Automations are only offered for the presses the button reports
+	var valid []int
+	for _, event := range []int{
+		characteristic.ProgrammableSwitchEventSinglePress,
+		characteristic.ProgrammableSwitchEventDoublePress,
+		characteristic.ProgrammableSwitchEventLongPress,
+	} {
+		payload := payloads[event]
+		if payload == "" {
+			continue
+		}
+		if _, dup := b.events[strings.ToLower(payload)]; dup {
+			return nil, fmt.Errorf("duplicate payload %q", payload)
+		}
+		b.events[strings.ToLower(payload)] = event
+		valid = append(valid, event)
+	}
+	b.ProgrammableSwitchEvent.ValidVals = valid
+
+	name := characteristic.NewName()
+	name.SetValue(fmt.Sprintf("Button %d", index))
+	if cfg.Name != "" {
+		name.SetValue(cfg.Name)
+	}
+	b.AddC(name.C)
+
+	label := characteristic.NewServiceLabelIndex()
+	label.SetValue(index)
+	b.AddC(label.C)
+
+	return b, nil
+}
+
+type ProgrammableSwitch struct {
+	*accessory.A
+	Buttons []*programmableButton
+	*Reachability
+	settings config.ProgrammableSwitchSettings
+	config   config.Device
+}
+
+func NewProgrammableSwitch(id int, cfg config.Device) (*ProgrammableSwitch, error) {
+	var settings config.ProgrammableSwitchSettings
+	if err := cfg.Decode(&settings); err != nil {
+		return nil, err
+	}
+	if len(settings.Buttons) == 0 {
+		return nil, errors.New("no buttons")
+	}
+
+	name := cfg.Name
+	model := "Programmable Switch"
+	if cfg.FriendlyName != "" {
+		name = cfg.FriendlyName
+		model = fmt.Sprintf("%s (%s)", model, cfg.Name)
+	}
+
+	a := ProgrammableSwitch{}
+	a.A = accessory.New(accessory.Info{
+		Name:         name,
+		Model:        model,
+		Manufacturer: "hap-mqtt",
+	}, accessory.TypeProgrammableSwitch)
+	a.Id = uint64(id)
+	log.Infof("HAP Create Accessory %4d - %s", a.Id, cfg.Name)
+
+	// Buttons are labelled by their index, in the order of the settings
+	for i, bc := range settings.Buttons {
+		b, err := newProgrammableButton(bc, i+1)
+		if err != nil {
+			return nil, fmt.Errorf("button %d: %w", i, err)
+		}
+		a.AddS(b.S)
+		a.Buttons = append(a.Buttons, b)
+	}
+	if len(a.Buttons) > 1 {
+		label := service.NewServiceLabel()
+		label.ServiceLabelNamespace.SetValue(characteristic.ServiceLabelNamespaceArabicNumerals)
+		a.AddS(label.S)
+	}
+
+	a.Reachability = newReachability(a.A, cfg)
+	a.settings = settings
+	a.config = cfg
+
+	return &a, nil
+}
+
+func (a *ProgrammableSwitch) Accessory() *accessory.A {
+	return a.A
+}
+
+func (a *ProgrammableSwitch) topic(t string) string {
+	return strings.ReplaceAll(t, "{name}", a.config.Name)
+}
+
+func (a *ProgrammableSwitch) Listen(client mqtt.Client) {
+	// MQTT -> HAP
+	if avail := a.settings.Availability; avail != nil && avail.Topic != "" {
+		a.listenAvailability(client, a.topic(avail.Topic), avail)
+	}
+
+	// Buttons may share a topic, e.g. the rockers of an EnOcean switch
+	for _, b := range a.Buttons {
+		subButton := a.topic(b.config.Topic)
+		client.Subscribe(subButton, 1, func(_ mqtt.Client, msg mqtt.Message) {
+			msg.Ack()
+			log.Debugf("MQTT received %s from %s", msg.Payload(), msg.Topic())
+
+			payload := string(msg.Payload())
+			if b.config.JSONPath != "" {
+				v, err := lookupJSON(msg.Payload(), b.config.JSONPath)
+				if err != nil {
+					// Other messages on the topic, e.g. the results of other commands
+					log.Debugf("MQTT ignored %s from %s: %v", msg.Payload(), msg.Topic(), err)
+					return
+				}
+				payload = fmt.Sprint(v)
+			}
+
+			event, ok := b.events[strings.ToLower(strings.TrimSpace(payload))]
+			if !ok {
+				return
+			}
+			// Retained or replayed messages are no presses
+			if msg.Retained() {
+				return
+			}
+			log.Debugf("HAP %s press %d", a.config.Name, event)
+			b.ProgrammableSwitchEvent.SetValue(event)
+		})
+	}
+}
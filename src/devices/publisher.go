@@ -0,0 +1,174 @@
+package devices
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	publishQueueSize      = 64
+	defaultPublishTimeout = 5 * time.Second
+)
+
+var (
+	ErrPublishDropped = errors.New("publish queue full, dropped")
+	ErrPublishTimeout = errors.New("publish timed out")
+)
+
+// Publisher queues the messages published by devices and publishes them
+// in the background, so a stalled broker never blocks the HAP request
+// handlers. Messages are published in order, the acknowledgements are
+// awaited per message, so a slow one does not hold up the others. Every
+// message completes within the publish timeout, including the time queued.
+type Publisher struct {
+	client  mqtt.Client
+	timeout time.Duration
+	queue   chan *publishToken
+
+	published atomic.Uint64
+	failed    atomic.Uint64
+	dropped   atomic.Uint64
+	late      atomic.Uint64
+}
+
+func NewPublisher(timeout time.Duration) *Publisher {
+	if timeout <= 0 {
+		timeout = defaultPublishTimeout
+	}
+
+	return &Publisher{
+		timeout: timeout,
+		queue:   make(chan *publishToken, publishQueueSize),
+	}
+}
+
+// SetClient sets the MQTT client and starts publishing the queue.
+// Call it once, before it connects.
+func (p *Publisher) SetClient(client mqtt.Client) {
+	p.client = client
+	go p.run()
+}
+
+// Publish queues a message and returns immediately. The returned token
+// completes once the broker acknowledged the message, or with an error
+// when it was dropped or timed out.
+func (p *Publisher) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	t := &publishToken{
+		topic:    topic,
+		qos:      qos,
+		retained: retained,
+		payload:  payload,
+		done:     make(chan struct{}),
+	}
+	timer := time.AfterFunc(p.timeout, func() {
+		if t.complete(ErrPublishTimeout) {
+			p.failed.Add(1)
+		}
+	})
+
+	select {
+	case p.queue <- t:
+	default:
+		timer.Stop()
+		p.dropped.Add(1)
+		log.Warn("MQTT publish dropped", "topic", topic)
+		t.complete(ErrPublishDropped)
+	}
+
+	return t
+}
+
+func (p *Publisher) run() {
+	for t := range p.queue {
+		// Timed out while queued, HomeKit was told the command failed
+		if t.completed.Load() {
+			continue
+		}
+		token := p.client.Publish(t.topic, t.qos, t.retained, t.payload)
+		go p.wait(t, token)
+	}
+}
+
+// wait completes t once the broker acknowledged the message. Messages
+// still published after timing out are logged, as HomeKit was told the
+// command failed.
+func (p *Publisher) wait(t *publishToken, token mqtt.Token) {
+	<-token.Done()
+	err := token.Error()
+	if !t.complete(err) {
+		if err == nil {
+			p.late.Add(1)
+			log.Warn("MQTT published late", "topic", t.topic)
+		}
+		return
+	}
+
+	if err != nil {
+		p.failed.Add(1)
+		return
+	}
+	p.published.Add(1)
+}
+
+// LogStats logs the number of published, failed, dropped and late messages.
+func (p *Publisher) LogStats() {
+	log.Info("MQTT publisher",
+		"published", p.published.Load(),
+		"failed", p.failed.Load(),
+		"dropped", p.dropped.Load(),
+		"late", p.late.Load())
+}
+
+// publishToken is the token of a queued message.
+type publishToken struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  interface{}
+
+	done      chan struct{}
+	completed atomic.Bool
+	err       error
+}
+
+// complete reports whether it completed t, which completes only once.
+func (t *publishToken) complete(err error) bool {
+	if !t.completed.CompareAndSwap(false, true) {
+		return false
+	}
+	t.err = err
+	close(t.done)
+	return true
+}
+
+func (t *publishToken) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *publishToken) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *publishToken) Done() <-chan struct{} { return t.done }
+
+func (t *publishToken) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
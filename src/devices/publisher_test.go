@@ -0,0 +1,124 @@
+package devices
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+var errBroker = errors.New("broker error")
+
+// stallingBroker acknowledges or fails messages by topic, or never
+// acknowledges them.
+type stallingBroker struct {
+	mqtt.Client
+	release chan struct{} // Publishing "block" blocks until closed
+
+	mu        sync.Mutex
+	published []string
+}
+
+func (b *stallingBroker) Publish(topic string, _ byte, _ bool, _ interface{}) mqtt.Token {
+	b.mu.Lock()
+	b.published = append(b.published, topic)
+	b.mu.Unlock()
+
+	t := &brokerToken{done: make(chan struct{})}
+	switch topic {
+	case "ack":
+		close(t.done)
+	case "fail":
+		t.err = errBroker
+		close(t.done)
+	case "block":
+		<-b.release
+		close(t.done)
+	}
+	return t
+}
+
+type brokerToken struct {
+	done chan struct{}
+	err  error
+}
+
+func (t *brokerToken) Wait() bool { <-t.done; return true }
+func (t *brokerToken) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+func (t *brokerToken) Done() <-chan struct{} { return t.done }
+func (t *brokerToken) Error() error          { return t.err }
+
+func TestPublisher(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name          string
+		topics        []string
+		wantErrs      []error
+		wantPublished []string
+	}{
+		{
+			name:          "acknowledged",
+			topics:        []string{"ack", "ack"},
+			wantErrs:      []error{nil, nil},
+			wantPublished: []string{"ack", "ack"},
+		},
+		{
+			name:          "slow acknowledgement does not hold up others",
+			topics:        []string{"stall", "ack", "fail"},
+			wantErrs:      []error{ErrPublishTimeout, nil, errBroker},
+			wantPublished: []string{"stall", "ack", "fail"},
+		},
+		{
+			name:          "timed out while queued",
+			topics:        []string{"block", "ack"},
+			wantErrs:      []error{ErrPublishTimeout, ErrPublishTimeout},
+			wantPublished: []string{"block"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := &stallingBroker{release: make(chan struct{})}
+			p := NewPublisher(timeout)
+			p.SetClient(broker)
+
+			var tokens []mqtt.Token
+			for _, topic := range tt.topics {
+				tokens = append(tokens, p.Publish(topic, 1, false, ""))
+			}
+			// Acknowledged messages complete before the others time out
+			for i, token := range tokens {
+				if tt.wantErrs[i] == nil && !token.WaitTimeout(timeout/2) {
+					t.Errorf("message %d not completed before the timeout", i)
+				}
+			}
+			for i, token := range tokens {
+				if !token.WaitTimeout(2 * timeout) {
+					t.Fatalf("message %d not completed within twice the timeout", i)
+				}
+				if err := token.Error(); err != tt.wantErrs[i] {
+					t.Errorf("message %d error = %v, want %v", i, err, tt.wantErrs[i])
+				}
+			}
+
+			close(broker.release)
+			time.Sleep(timeout / 5)
+			broker.mu.Lock()
+			defer broker.mu.Unlock()
+			if !reflect.DeepEqual(broker.published, tt.wantPublished) {
+				t.Errorf("published %v, want %v", broker.published, tt.wantPublished)
+			}
+		})
+	}
+}
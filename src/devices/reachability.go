@@ -0,0 +1,221 @@
+package devices
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"senhaerens.be/hap-mqtt/config"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/charmbracelet/log"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// brokerConnected is shared by all devices, which are not reachable
+// while the MQTT broker is not.
+var brokerConnected atomic.Bool
+
+// SetBrokerConnected updates the MQTT broker connection state.
+func SetBrokerConnected(connected bool) {
+	brokerConnected.Store(connected)
+}
+
+// Reachability tracks the online state reported by a device's LWT topic.
+// While the device or the MQTT broker is offline, HAP reads and writes
+// fail with a service communication failure so the Home app shows
+// "No Response". Writes fail as well when their command is not published,
+// and reads after a command failed, until the next command succeeds or
+// the device reports its state.
+type Reachability struct {
+	name   string
+	online atomic.Bool
+	failed atomic.Bool
+
+	confirm  *config.Confirm
+	mu       sync.Mutex
+	pending  map[*characteristic.C]*pendingCommand
+	reported map[*characteristic.C]interface{}
+
+	commands   map[*characteristic.C][]func(v interface{})
+	writeMu    sync.Mutex   // Serializes the writes collecting their published messages
+	collecting bool         // A write is running its commands
+	sent       []mqtt.Token // Published by the commands of the running write
+}
+
+// newReachability guards every characteristic of the accessory services
+// added so far. Call it after all services have been added.
+func newReachability(a *accessory.A, cfg config.Device) *Reachability {
+	r := &Reachability{
+		name:     cfg.Name,
+		confirm:  cfg.Confirm,
+		pending:  map[*characteristic.C]*pendingCommand{},
+		reported: map[*characteristic.C]interface{}{},
+		commands: map[*characteristic.C][]func(v interface{}){},
+	}
+	r.online.Store(true)
+
+	for _, s := range a.Ss {
+		if s.Type == service.TypeAccessoryInformation {
+			continue
+		}
+		for _, c := range s.Cs {
+			r.guard(c)
+		}
+	}
+
+	return r
+}
+
+func (r *Reachability) guard(c *characteristic.C) {
+	read := c.ValueRequestFunc
+	c.ValueRequestFunc = func(req *http.Request) (interface{}, int) {
+		if !r.Online() || r.failed.Load() {
+			return nil, hap.JsonStatusServiceCommunicationFailure
+		}
+		if read != nil {
+			return read(req)
+		}
+		return c.Value(), 0
+	}
+
+	write := c.SetValueRequestFunc
+	c.SetValueRequestFunc = func(v interface{}, req *http.Request) (interface{}, int) {
+		if !r.Online() {
+			return nil, hap.JsonStatusServiceCommunicationFailure
+		}
+		var resp interface{}
+		if write != nil {
+			var status int
+			if resp, status = write(v, req); status != 0 {
+				return resp, status
+			}
+		}
+		return resp, r.runCommands(c, v)
+	}
+}
+
+// onCommand registers fn to send the command for a HomeKit write of c.
+// Unlike OnValueRemoteUpdate, fn runs before the written value is set, so
+// the write fails when the command is not published in time.
+func onCommand[T any](r *Reachability, c *characteristic.C, fn func(v T)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.commands[c] = append(r.commands[c], func(v interface{}) {
+		fn(v.(T))
+	})
+}
+
+// runCommands runs the commands of a write of c and waits for the messages
+// they publish, returning a HAP status. The publisher completes every
+// message within mqtt.publish_timeout, which bounds the wait.
+func (r *Reachability) runCommands(c *characteristic.C, v interface{}) int {
+	r.mu.Lock()
+	commands := r.commands[c]
+	r.mu.Unlock()
+	if len(commands) == 0 {
+		return 0
+	}
+
+	r.writeMu.Lock()
+	r.mu.Lock()
+	r.collecting = true
+	r.mu.Unlock()
+	for _, fn := range commands {
+		fn(v)
+	}
+	r.mu.Lock()
+	sent := r.sent
+	r.collecting, r.sent = false, nil
+	r.mu.Unlock()
+	r.writeMu.Unlock()
+
+	for _, token := range sent {
+		if token.Wait() && token.Error() != nil {
+			r.failed.Store(true)
+			return hap.JsonStatusServiceCommunicationFailure
+		}
+	}
+	if len(sent) > 0 {
+		r.failed.Store(false)
+	}
+
+	return 0
+}
+
+// Online reports whether the device is reachable.
+func (r *Reachability) Online() bool {
+	return r.online.Load() && brokerConnected.Load()
+}
+
+// SetOnline updates the reachability and logs state changes.
+func (r *Reachability) SetOnline(online bool) {
+	if r.online.Swap(online) == online {
+		return
+	}
+
+	if online {
+		log.Infof("MQTT %s is online", r.name)
+	} else {
+		log.Infof("MQTT %s is offline", r.name)
+	}
+}
+
+// listenAvailability subscribes to a configured availability topic.
+func (r *Reachability) listenAvailability(client mqtt.Client, topic string, avail *config.GenericAvailability) {
+	offline := "offline"
+	if avail.PayloadOffline != "" {
+		offline = avail.PayloadOffline
+	}
+
+	client.Subscribe(topic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		msg.Ack()
+		log.Debugf("MQTT received %s from %s", msg.Payload(), msg.Topic())
+
+		payload := string(msg.Payload())
+		if avail.JSONPath != "" {
+			v, err := lookupJSON(msg.Payload(), avail.JSONPath)
+			if err != nil {
+				log.Error("Failed to decode JSON payload", "err", err)
+				return
+			}
+			payload = fmt.Sprint(v)
+		}
+
+		r.SetOnline(!strings.EqualFold(payload, offline))
+	})
+}
+
+// publish publishes a message and logs the outcome in the background.
+// Only a failed HomeKit write marks the device as failed, not e.g. a
+// failed state request.
+func (r *Reachability) publish(client mqtt.Client, topic string, payload string) {
+	token := r.send(client, topic, payload)
+	go func() {
+		<-token.Done()
+		if err := token.Error(); err != nil {
+			log.Error("MQTT publish failed", "device", r.name, "topic", topic, "error", err)
+			return
+		}
+		log.Debugf("MQTT published %s to %s", payload, topic)
+	}()
+}
+
+// send publishes a message, which a running write waits for.
+func (r *Reachability) send(client mqtt.Client, topic string, payload string) mqtt.Token {
+	token := client.Publish(topic, 1, false, payload)
+
+	r.mu.Lock()
+	if r.collecting {
+		r.sent = append(r.sent, token)
+	}
+	r.mu.Unlock()
+
+	return token
+}
@@ -0,0 +1,189 @@
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"senhaerens.be/hap-mqtt/config"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// Device is an accessory bridged to MQTT.
+type Device interface {
+	Listen(mqtt.Client)
+	Accessory() *accessory.A
+}
+
+// StateRequester is implemented by devices which can ask the physical
+// device to publish its current state, e.g. after startup.
+type StateRequester interface {
+	RequestState(mqtt.Client)
+}
+
+// StateStore persists device state across restarts.
+type StateStore interface {
+	Get(key string, v interface{}) bool
+	Set(key string, v interface{})
+}
+
+// StatePersister is implemented by devices with state beyond their
+// characteristic values, which are persisted for every device.
+type StatePersister interface {
+	RestoreState(StateStore)
+}
+
+// Linker is implemented by devices referencing other devices by name,
+// e.g. a thermostat. Link is called once all devices listen, lookup
+// returns the devices configured with a name for any driver.
+type Linker interface {
+	Link(lookup func(name string) []Device) error
+}
+
+// Closer is implemented by devices with background work, which is stopped
+// when the device is replaced or removed.
+type Closer interface {
+	Close()
+}
+
+// Option documents a positional entry of config.Device.Options.
+type Option struct {
+	Name        string
+	Description string
+	Required    bool
+	Values      []string // Allowed values, any value when empty
+}
+
+// Driver describes a device type which can be configured below the
+// "devices" key in config.yml.
+type Driver struct {
+	Key         string // Configuration key
+	Description string
+	Options     []Option
+	Offset      int  // Legacy accessory ID of the first device, adopted once when migrating to stable IDs. 0 without legacy IDs
+	Confirm     bool // Supports confirming commands by the state echo of the device
+
+	// Settings returns a pointer to the driver specific settings, which
+	// config.Device.Decode fills in. Nil when the driver has none.
+	Settings func() interface{}
+
+	New func(id int, config config.Device) (Device, error)
+}
+
+var drivers = map[string]Driver{}
+
+// Register makes a driver available by its configuration key.
+// Drivers register themselves in an init function, so out-of-tree
+// drivers are added by importing their package.
+func Register(d Driver) {
+	if d.Key == "" || d.New == nil {
+		panic("devices: Register driver without key or constructor")
+	}
+	if _, dup := drivers[d.Key]; dup {
+		panic("devices: Register called twice for driver " + d.Key)
+	}
+	drivers[d.Key] = d
+}
+
+// Drivers returns the registered drivers ordered by key.
+func Drivers() []Driver {
+	list := make([]Driver, 0, len(drivers))
+	for _, key := range slices.Sorted(maps.Keys(drivers)) {
+		list = append(list, drivers[key])
+	}
+
+	return list
+}
+
+// Validate checks the device configurations against the registered drivers.
+func Validate(devices map[string][]config.Device) error {
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(devices)) {
+		configs := devices[key]
+		d, ok := drivers[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown driver %q (registered: %s)", key, driverKeys()))
+			continue
+		}
+
+		names := map[string]bool{}
+		for _, cfg := range configs {
+			if err := d.validate(cfg); err != nil {
+				errs = append(errs, fmt.Errorf("%s %q: %w", key, cfg.Name, err))
+			}
+			if names[cfg.Name] {
+				errs = append(errs, fmt.Errorf("%s %q: duplicate name", key, cfg.Name))
+			}
+			names[cfg.Name] = true
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (d Driver) validate(cfg config.Device) error {
+	if cfg.Name == "" {
+		return errors.New("name is missing")
+	}
+
+	if len(cfg.Options) > len(d.Options) {
+		return fmt.Errorf("too many options, expected at most %d", len(d.Options))
+	}
+	for i, o := range d.Options {
+		if i >= len(cfg.Options) || cfg.Options[i] == "" {
+			if o.Required {
+				return fmt.Errorf("option %q is missing", o.Name)
+			}
+			continue
+		}
+		if len(o.Values) > 0 && !slices.Contains(o.Values, cfg.Options[i]) {
+			return fmt.Errorf("option %q must be one of %s", o.Name, strings.Join(o.Values, ", "))
+		}
+	}
+
+	if cfg.Confirm != nil {
+		if !d.Confirm {
+			return errors.New("confirm is not supported")
+		}
+		if cfg.Confirm.Timeout < 0 || cfg.Confirm.Retries < 0 {
+			return errors.New("confirm timeout and retries must not be negative")
+		}
+	}
+
+	if d.Settings == nil {
+		if len(cfg.Settings) > 0 {
+			return fmt.Errorf("unknown fields %s", strings.Join(slices.Sorted(maps.Keys(cfg.Settings)), ", "))
+		}
+		return nil
+	}
+
+	return cfg.Decode(d.Settings())
+}
+
+// Usage describes the registered drivers and their options.
+func Usage() string {
+	var b strings.Builder
+	for _, d := range Drivers() {
+		fmt.Fprintf(&b, "%s: %s\n", d.Key, d.Description)
+		for i, o := range d.Options {
+			required := ""
+			if o.Required {
+				required = ", required"
+			}
+			fmt.Fprintf(&b, "  options[%d] %s: %s%s\n", i, o.Name, o.Description, required)
+		}
+		if d.Confirm {
+			fmt.Fprintf(&b, "  confirm: supported\n")
+		}
+	}
+
+	return b.String()
+}
+
+func driverKeys() string {
+	return strings.Join(slices.Sorted(maps.Keys(drivers)), ", ")
+}
@@ -20,9 +20,22 @@ type SdStatus struct {
 	Brightness *int  `json:"brightness"`
 }
 
+func init() {
+	Register(Driver{
+		Key:         "shelly_dimmers",
+		Description: "Shelly Dimmer Gen3",
+		Offset:      500,
+		Confirm:     true,
+		New: func(id int, config config.Device) (Device, error) {
+			return NewShellyDimmer(id, config), nil
+		},
+	})
+}
+
 type ShellyDimmer struct {
 	*accessory.A
 	*service.DimmableLightbulb
+	*Reachability
 	config config.Device
 }
 
@@ -46,6 +59,7 @@ func NewShellyDimmer(id int, config config.Device) *ShellyDimmer {
 	a.DimmableLightbulb = service.NewDimmableLightbulb()
 	a.AddS(a.DimmableLightbulb.S)
 
+	a.Reachability = newReachability(a.A, config)
 	a.config = config
 
 	return &a
@@ -63,9 +77,7 @@ func (a *ShellyDimmer) Listen(client mqtt.Client) {
 		payload := string(msg.Payload())
 		log.Debugf("MQTT received %s from %s", payload, msg.Topic())
 
-		if strings.ToLower(payload) == "false" {
-			log.Infof("MQTT %s is offline", a.config.Name)
-		}
+		a.SetOnline(strings.ToLower(payload) != "false")
 	})
 
 	subStatus := fmt.Sprintf("shellies/%s/status/light:0", a.config.Name)
@@ -84,26 +96,31 @@ func (a *ShellyDimmer) Listen(client mqtt.Client) {
 			return
 		}
 
-		a.On.SetValue(*status.Output)
-		a.Brightness.SetValue(*status.Brightness)
+		a.report(a.On.C, *status.Output)
+		a.report(a.Brightness.C, *status.Brightness)
 	})
 
 	// HAP -> MQTT
 	pubStatus := fmt.Sprintf("shellies/%s/command/light:0", a.config.Name)
-	a.Brightness.OnValueRemoteUpdate(func(brightness int) {
-		payload := fmt.Sprintf("set,false,0")
-		if brightness > 0 {
-			payload = fmt.Sprintf("set,true,%d", brightness)
+	onCommand(a.Reachability, a.Brightness.C, func(brightness int) {
+		if brightness == 0 {
+			// Turning off keeps the brightness, so the output confirms it
+			a.command(client, a.On.C, false, pubStatus, "set,false,0")
+			return
 		}
-		token := client.Publish(pubStatus, 1, false, payload)
-		token.Wait()
-		log.Debugf("MQTT published %d to %s", payload, pubStatus)
+		payload := fmt.Sprintf("set,true,%d", brightness)
+		a.command(client, a.Brightness.C, brightness, pubStatus, payload)
 	})
 
-	a.On.OnValueRemoteUpdate(func(on bool) {
+	onCommand(a.Reachability, a.On.C, func(on bool) {
 		payload := fmt.Sprintf("set,%s", strconv.FormatBool(on))
-		token := client.Publish(pubStatus, 1, false, payload)
-		token.Wait()
-		log.Debugf("MQTT published %s to %s", payload, pubStatus)
+		a.command(client, a.On.C, on, pubStatus, payload)
 	})
 }
+
+// RequestState asks the Shelly to publish its status topics.
+func (a *ShellyDimmer) RequestState(client mqtt.Client) {
+	pubCommand := fmt.Sprintf("shellies/%s/command", a.config.Name)
+	payload := "status_update"
+	a.publish(client, pubCommand, payload)
+}
@@ -0,0 +1,420 @@
+package devices
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"senhaerens.be/hap-mqtt/config"
+	hmservice "senhaerens.be/hap-mqtt/service"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/charmbracelet/log"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+func init() {
+	Register(Driver{
+		Key:         "shelly_rpc",
+		Description: "Shelly Gen2/Gen3 device controlled by JSON-RPC",
+		Confirm:     true,
+		Settings: func() interface{} {
+			return &config.ShellyRPCSettings{}
+		},
+		New: func(id int, config config.Device) (Device, error) {
+			return NewShellyRPC(id, config)
+		},
+	})
+}
+
+// SrpcFrame is a JSON-RPC frame: a notification on <prefix>/events/rpc
+// or the response to a request.
+type SrpcFrame struct {
+	Method string                     `json:"method"`
+	Params map[string]json.RawMessage `json:"params"`
+	Result map[string]json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// SrpcEvents are the params of a NotifyEvent notification.
+type SrpcEvents struct {
+	Events []struct {
+		Component string `json:"component"` // e.g. input:0
+		Event     string `json:"event"`     // e.g. single_push
+	} `json:"events"`
+}
+
+// SrpcStatus is the status of a component. Notifications only carry the
+// fields which changed, so use pointer values to check for 'nil'.
+type SrpcStatus struct {
+	Output     *bool       `json:"output"`      // Switch and light
+	Brightness *int        `json:"brightness"`  // Light
+	State      interface{} `json:"state"`       // Input (bool) and cover (string)
+	CurrentPos *int        `json:"current_pos"` // Cover
+	TargetPos  *int        `json:"target_pos"`  // Cover
+	SlatPos    *int        `json:"slat_pos"`    // Cover with slats
+}
+
+// srpcComponent is a component of a Shelly device, e.g. switch:0, exposed
+// as a HomeKit service.
+type srpcComponent struct {
+	key     string // e.g. switch:0
+	service *service.S
+	config  config.ShellyRPCComponent
+
+	listen func(a *ShellyRPC, client mqtt.Client)
+	update func(a *ShellyRPC, status SrpcStatus)
+	event  func(a *ShellyRPC, event string) // Input only
+}
+
+// srpcEvents maps the input events to the programmable switch events.
+var srpcEvents = map[string]int{
+	"single_push": characteristic.ProgrammableSwitchEventSinglePress,
+	"double_push": characteristic.ProgrammableSwitchEventDoublePress,
+	"long_push":   characteristic.ProgrammableSwitchEventLongPress,
+}
+
+type ShellyRPC struct {
+	*accessory.A
+	Components []*srpcComponent
+	*Reachability
+	prefix string
+	src    string // Source of the requests, the responses are published to <src>/rpc
+	id     atomic.Uint64
+	config config.Device
+}
+
+func NewShellyRPC(id int, cfg config.Device) (*ShellyRPC, error) {
+	var settings config.ShellyRPCSettings
+	if err := cfg.Decode(&settings); err != nil {
+		return nil, err
+	}
+	if len(settings.Components) == 0 {
+		return nil, errors.New("no components")
+	}
+
+	var components []*srpcComponent
+	var category byte
+	keys := map[string]bool{}
+	labels := false
+	for i, cc := range settings.Components {
+		comp, c, err := newSrpcComponent(cc)
+		if err != nil {
+			return nil, fmt.Errorf("component %d: %w", i, err)
+		}
+		if keys[comp.key] {
+			return nil, fmt.Errorf("component %d: duplicate component %s", i, comp.key)
+		}
+		keys[comp.key] = true
+		// The first component determines the accessory category
+		if i == 0 {
+			category = c
+		}
+
+		name := characteristic.NewName()
+		name.SetValue(comp.key)
+		if cc.Name != "" {
+			name.SetValue(cc.Name)
+		}
+		comp.service.AddC(name.C)
+
+		// Programmable switches are told apart by their label index
+		if comp.event != nil {
+			index := characteristic.NewServiceLabelIndex()
+			index.SetValue(cc.ID + 1)
+			comp.service.AddC(index.C)
+			labels = true
+		}
+
+		components = append(components, comp)
+	}
+
+	name := cfg.Name
+	model := "Shelly"
+	if cfg.FriendlyName != "" {
+		name = cfg.FriendlyName
+		model = fmt.Sprintf("%s (%s)", model, cfg.Name)
+	}
+
+	a := ShellyRPC{}
+	a.A = accessory.New(accessory.Info{
+		Name:         name,
+		Model:        model,
+		Manufacturer: "Shelly",
+	}, category)
+	a.Id = uint64(id)
+	log.Infof("HAP Create Accessory %4d - %s", a.Id, cfg.Name)
+
+	// The first component is the primary service, linked to the others
+	for i, comp := range components {
+		a.AddS(comp.service)
+		if i == 0 {
+			comp.service.Primary = true
+			continue
+		}
+		components[0].service.AddS(comp.service)
+	}
+	if labels {
+		label := service.NewServiceLabel()
+		label.ServiceLabelNamespace.SetValue(characteristic.ServiceLabelNamespaceArabicNumerals)
+		a.AddS(label.S)
+	}
+	a.Components = components
+
+	a.Reachability = newReachability(a.A, cfg)
+	a.prefix = settings.Prefix
+	if a.prefix == "" {
+		a.prefix = cfg.Name
+	}
+	a.src = fmt.Sprintf("hap-mqtt/%s", cfg.Name)
+	a.config = cfg
+
+	return &a, nil
+}
+
+func newSrpcComponent(cc config.ShellyRPCComponent) (*srpcComponent, byte, error) {
+	if cc.ID < 0 {
+		return nil, 0, fmt.Errorf("invalid id %d", cc.ID)
+	}
+	comp := &srpcComponent{key: fmt.Sprintf("%s:%d", cc.Type, cc.ID), config: cc}
+	if cc.Service != "" && cc.Type != "switch" && cc.Type != "input" {
+		return nil, 0, fmt.Errorf("%s: service is not supported", comp.key)
+	}
+	if cc.Tilt && cc.Type != "cover" {
+		return nil, 0, fmt.Errorf("%s: tilt is not supported", comp.key)
+	}
+
+	switch cc.Type {
+	case "switch":
+		power, category, err := newTasmotaPower(cc.Service)
+		if err != nil {
+			return nil, 0, err
+		}
+		power.inUseWhileOn()
+		comp.service = power.Service
+		comp.listen = func(a *ShellyRPC, client mqtt.Client) {
+			onCommand(a.Reachability, power.On.C, func(on bool) {
+				a.call(client, power.On.C, on, "Switch.Set", map[string]interface{}{"id": cc.ID, "on": on})
+			})
+		}
+		comp.update = func(a *ShellyRPC, status SrpcStatus) {
+			if status.Output != nil {
+				a.report(power.On.C, *status.Output)
+			}
+		}
+		return comp, category, nil
+
+	case "light":
+		light := hmservice.NewDimmableLightbulb()
+		comp.service = light.S
+		comp.listen = func(a *ShellyRPC, client mqtt.Client) {
+			onCommand(a.Reachability, light.Brightness.C, func(brightness int) {
+				if brightness == 0 {
+					// Turning off keeps the brightness, so the output confirms it
+					a.call(client, light.On.C, false, "Light.Set", map[string]interface{}{"id": cc.ID, "on": false})
+					return
+				}
+				a.call(client, light.Brightness.C, brightness, "Light.Set", map[string]interface{}{"id": cc.ID, "on": true, "brightness": brightness})
+			})
+			onCommand(a.Reachability, light.On.C, func(on bool) {
+				a.call(client, light.On.C, on, "Light.Set", map[string]interface{}{"id": cc.ID, "on": on})
+			})
+		}
+		comp.update = func(a *ShellyRPC, status SrpcStatus) {
+			if status.Output != nil {
+				a.report(light.On.C, *status.Output)
+			}
+			if status.Brightness != nil {
+				a.report(light.Brightness.C, *status.Brightness)
+			}
+		}
+		return comp, accessory.TypeLightbulb, nil
+
+	case "cover":
+		cover := newWindowCovering(cc.Tilt)
+		comp.service = cover.S
+		comp.listen = func(a *ShellyRPC, client mqtt.Client) {
+			onCommand(a.Reachability, cover.TargetPosition.C, func(pos int) {
+				a.call(client, cover.TargetPosition.C, pos, "Cover.GoToPosition", map[string]interface{}{"id": cc.ID, "pos": pos})
+			})
+			if cover.TargetTilt != nil {
+				onCommand(a.Reachability, cover.TargetTilt.C, func(angle int) {
+					a.call(client, cover.TargetTilt.C, angle, "Cover.GoToPosition", map[string]interface{}{"id": cc.ID, "slat_pos": tiltPercent(angle)})
+				})
+			}
+		}
+		comp.update = func(a *ShellyRPC, status SrpcStatus) {
+			cover.reportShelly(a.Reachability, status)
+		}
+		return comp, accessory.TypeWindowCovering, nil
+
+	case "input":
+		switch cc.Service {
+		case "", "contact_sensor":
+			sensor := service.NewContactSensor()
+			comp.service = sensor.S
+			comp.update = func(_ *ShellyRPC, status SrpcStatus) {
+				switch status.State {
+				case true:
+					sensor.ContactSensorState.SetValue(characteristic.ContactSensorStateContactDetected)
+				case false:
+					sensor.ContactSensorState.SetValue(characteristic.ContactSensorStateContactNotDetected)
+				}
+			}
+			return comp, accessory.TypeSensor, nil
+
+		case "programmable_switch":
+			button := service.NewStatelessProgrammableSwitch()
+			comp.service = button.S
+			comp.event = func(_ *ShellyRPC, event string) {
+				if v, ok := srpcEvents[event]; ok {
+					button.ProgrammableSwitchEvent.SetValue(v)
+				}
+			}
+			return comp, accessory.TypeProgrammableSwitch, nil
+
+		default:
+			return nil, 0, fmt.Errorf("%s: unknown service %q, expected contact_sensor or programmable_switch", comp.key, cc.Service)
+		}
+
+	default:
+		return nil, 0, fmt.Errorf("unknown type %q, expected switch, light, cover or input", cc.Type)
+	}
+}
+
+func (a *ShellyRPC) Accessory() *accessory.A {
+	return a.A
+}
+
+func (a *ShellyRPC) Listen(client mqtt.Client) {
+	// MQTT -> HAP
+	subOnline := fmt.Sprintf("%s/online", a.prefix)
+	client.Subscribe(subOnline, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		msg.Ack()
+		payload := string(msg.Payload())
+		log.Debugf("MQTT received %s from %s", payload, msg.Topic())
+
+		a.SetOnline(strings.ToLower(payload) != "false")
+	})
+
+	// Full component status, published when "Generic status update over MQTT" is enabled
+	for _, comp := range a.Components {
+		if comp.update == nil {
+			continue
+		}
+		subStatus := fmt.Sprintf("%s/status/%s", a.prefix, comp.key)
+		client.Subscribe(subStatus, 1, func(_ mqtt.Client, msg mqtt.Message) {
+			msg.Ack()
+			log.Debugf("MQTT received %s from %s", msg.Payload(), msg.Topic())
+
+			var status SrpcStatus
+			if err := json.Unmarshal(msg.Payload(), &status); err != nil {
+				log.Error("Failed to decode JSON payload", "err", err)
+				return
+			}
+			comp.update(a, status)
+		})
+	}
+
+	// Status changes and input events, and the responses to our requests
+	subEvents := fmt.Sprintf("%s/events/rpc", a.prefix)
+	subResponse := fmt.Sprintf("%s/rpc", a.src)
+	client.SubscribeMultiple(map[string]byte{subEvents: 1, subResponse: 1}, func(_ mqtt.Client, msg mqtt.Message) {
+		msg.Ack()
+		log.Debugf("MQTT received %s from %s", msg.Payload(), msg.Topic())
+
+		var frame SrpcFrame
+		if err := json.Unmarshal(msg.Payload(), &frame); err != nil {
+			log.Error("Failed to decode JSON payload", "err", err)
+			return
+		}
+
+		switch {
+		case frame.Error != nil:
+			log.Error("Shelly RPC request failed", "device", a.config.Name, "code", frame.Error.Code, "message", frame.Error.Message)
+		case frame.Result != nil:
+			a.updateStatus(frame.Result)
+		case frame.Method == "NotifyStatus" || frame.Method == "NotifyFullStatus":
+			a.updateStatus(frame.Params)
+		case frame.Method == "NotifyEvent" && !msg.Retained():
+			// Replayed events are no presses
+			a.notifyEvents(msg.Payload())
+		}
+	})
+
+	// HAP -> MQTT
+	for _, comp := range a.Components {
+		if comp.listen != nil {
+			comp.listen(a, client)
+		}
+	}
+}
+
+// updateStatus updates the components from a status by component key.
+func (a *ShellyRPC) updateStatus(status map[string]json.RawMessage) {
+	for _, comp := range a.Components {
+		raw, ok := status[comp.key]
+		if !ok || comp.update == nil {
+			continue
+		}
+		var s SrpcStatus
+		if err := json.Unmarshal(raw, &s); err != nil {
+			log.Error("Failed to decode component status", "device", a.config.Name, "component", comp.key, "err", err)
+			continue
+		}
+		comp.update(a, s)
+	}
+}
+
+func (a *ShellyRPC) notifyEvents(payload []byte) {
+	var frame struct {
+		Params SrpcEvents `json:"params"`
+	}
+	if err := json.Unmarshal(payload, &frame); err != nil {
+		log.Error("Failed to decode JSON payload", "err", err)
+		return
+	}
+
+	for _, e := range frame.Params.Events {
+		for _, comp := range a.Components {
+			if comp.key == e.Component && comp.event != nil {
+				log.Debugf("HAP %s %s", comp.key, e.Event)
+				comp.event(a, e.Event)
+			}
+		}
+	}
+}
+
+// request encodes a JSON-RPC request for method.
+func (a *ShellyRPC) request(method string, params map[string]interface{}) string {
+	req := map[string]interface{}{
+		"id":     a.id.Add(1),
+		"src":    a.src,
+		"method": method,
+	}
+	if params != nil {
+		req["params"] = params
+	}
+	b, _ := json.Marshal(req)
+	return string(b)
+}
+
+// call publishes a request setting c to want.
+func (a *ShellyRPC) call(client mqtt.Client, c *characteristic.C, want interface{}, method string, params map[string]interface{}) {
+	pubRPC := fmt.Sprintf("%s/rpc", a.prefix)
+	a.command(client, c, want, pubRPC, a.request(method, params))
+}
+
+// RequestState requests the status of all components, which the Shelly
+// answers on <src>/rpc.
+func (a *ShellyRPC) RequestState(client mqtt.Client) {
+	pubRPC := fmt.Sprintf("%s/rpc", a.prefix)
+	a.publish(client, pubRPC, a.request("Shelly.GetStatus", nil))
+}
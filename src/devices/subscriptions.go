@@ -0,0 +1,243 @@
+package devices
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+const unsubscribeTimeout = 5 * time.Second
+
+// Subscriptions multiplexes the MQTT subscriptions of all devices.
+// Paho keeps a single handler per topic filter, so without it devices
+// sharing a topic (e.g. the FHEM LWT) would replace each other's handler.
+// All subscriptions are recorded and replayed after a reconnect, as the
+// broker drops them when the session is clean.
+type Subscriptions struct {
+	client mqtt.Client
+	mu     sync.Mutex
+	topics map[string]*topicRoutes
+}
+
+type topicRoutes struct {
+	qos    byte
+	token  mqtt.Token
+	routes []*route
+	last   map[string]mqtt.Message // Last message per topic, replayed to late subscribers
+}
+
+type route struct {
+	owner   *Client
+	handler mqtt.MessageHandler
+}
+
+func NewSubscriptions() *Subscriptions {
+	return &Subscriptions{
+		topics: map[string]*topicRoutes{},
+	}
+}
+
+// SetClient sets the MQTT client, before it connects.
+func (s *Subscriptions) SetClient(client mqtt.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.client = client
+}
+
+// Resubscribe subscribes every recorded topic again. Call it on connect.
+func (s *Subscriptions) Resubscribe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for topic, t := range s.topics {
+		t.token = s.subscribe(topic, t.qos)
+	}
+	log.Debugf("MQTT resubscribed %d topics", len(s.topics))
+}
+
+// subscribe subscribes at the broker and logs the outcome.
+func (s *Subscriptions) subscribe(topic string, qos byte) mqtt.Token {
+	token := s.client.Subscribe(topic, qos, s.dispatch(topic))
+	go func() {
+		<-token.Done()
+		if err := subscribeError(token, topic); err != nil {
+			log.Error("MQTT subscribe failed", "topic", topic, "error", err)
+			return
+		}
+		log.Debugf("MQTT subscribed to %s", topic)
+	}()
+
+	return token
+}
+
+// subscribeError also reports subscriptions rejected by the broker,
+// which paho does not treat as an error.
+func subscribeError(token mqtt.Token, topic string) error {
+	if err := token.Error(); err != nil {
+		return err
+	}
+	if st, ok := token.(*mqtt.SubscribeToken); ok && st.Result()[topic] == 0x80 {
+		return errors.New("rejected by broker")
+	}
+	return nil
+}
+
+// Client returns an MQTT client for a single device, which publishes
+// through the shared publisher.
+func (s *Subscriptions) Client(pub *Publisher) *Client {
+	return &Client{Client: s.client, subs: s, pub: pub}
+}
+
+func (s *Subscriptions) add(owner *Client, topic string, qos byte, handler mqtt.MessageHandler) mqtt.Token {
+	s.mu.Lock()
+
+	t, ok := s.topics[topic]
+	if !ok {
+		t = &topicRoutes{qos: qos, last: map[string]mqtt.Message{}}
+		s.topics[topic] = t
+	}
+	t.routes = append(t.routes, &route{owner: owner, handler: handler})
+
+	// Subscribe at the broker for the first handler of a topic only,
+	// Resubscribe takes care of it while not connected
+	if t.token == nil && s.client.IsConnectionOpen() {
+		t.token = s.subscribe(topic, qos)
+	}
+
+	var token mqtt.Token = doneToken{}
+	if t.token != nil {
+		token = t.token
+	}
+	var replay []mqtt.Message
+	for _, msg := range t.last {
+		replay = append(replay, msg)
+	}
+	s.mu.Unlock()
+
+	// The broker only sends retained messages on the first subscription.
+	// Replayed messages are marked as retained, as they are no news either.
+	for _, msg := range replay {
+		handler(s.client, replayedMessage{msg})
+	}
+
+	return token
+}
+
+func (s *Subscriptions) dispatch(topic string) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		s.mu.Lock()
+		var routes []*route
+		if t, ok := s.topics[topic]; ok {
+			routes = append(routes, t.routes...)
+			t.last[msg.Topic()] = msg
+		}
+		s.mu.Unlock()
+
+		for _, r := range routes {
+			r.handler(client, msg)
+		}
+	}
+}
+
+// remove drops the handlers of owner for the given topics, or all topics
+// when none are given, and unsubscribes topics left without handlers.
+func (s *Subscriptions) remove(owner *Client, topics ...string) mqtt.Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	match := map[string]bool{}
+	for _, topic := range topics {
+		match[topic] = true
+	}
+
+	var unused []string
+	for topic, t := range s.topics {
+		if len(topics) > 0 && !match[topic] {
+			continue
+		}
+
+		kept := t.routes[:0]
+		for _, r := range t.routes {
+			if r.owner != owner {
+				kept = append(kept, r)
+			}
+		}
+		t.routes = kept
+
+		if len(t.routes) == 0 {
+			delete(s.topics, topic)
+			unused = append(unused, topic)
+		}
+	}
+
+	// The broker drops the subscriptions itself when disconnected
+	if len(unused) == 0 || !s.client.IsConnectionOpen() {
+		return doneToken{}
+	}
+	return s.client.Unsubscribe(unused...)
+}
+
+// Client is the MQTT client handed to a single device. Its subscriptions
+// are shared with other devices and can be removed together with Close.
+type Client struct {
+	mqtt.Client
+	subs *Subscriptions
+	pub  *Publisher
+}
+
+func (c *Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return c.pub.Publish(topic, qos, retained, payload)
+}
+
+func (c *Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.subs.add(c, topic, qos, callback)
+}
+
+func (c *Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	var token mqtt.Token = doneToken{}
+	for topic, qos := range filters {
+		token = c.subs.add(c, topic, qos, callback)
+	}
+	return token
+}
+
+func (c *Client) Unsubscribe(topics ...string) mqtt.Token {
+	if len(topics) == 0 {
+		return doneToken{}
+	}
+	return c.subs.remove(c, topics...)
+}
+
+// Close removes every subscription of the device. The handlers are removed
+// right away, waiting for the broker to unsubscribe is bounded so a stalled
+// broker does not block a reload.
+func (c *Client) Close() {
+	if !c.subs.remove(c).WaitTimeout(unsubscribeTimeout) {
+		log.Warn("MQTT unsubscribe timed out", "timeout", unsubscribeTimeout)
+	}
+}
+
+// replayedMessage is a message replayed to a late subscriber.
+type replayedMessage struct {
+	mqtt.Message
+}
+
+func (replayedMessage) Retained() bool { return true }
+
+// doneToken is a token for work which completed without a broker round trip.
+type doneToken struct{}
+
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+func (doneToken) Wait() bool                       { return true }
+func (doneToken) WaitTimeout(_ time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{}            { return closedChan }
+func (doneToken) Error() error                     { return nil }
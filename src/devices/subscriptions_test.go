@@ -0,0 +1,253 @@
+package devices
+
+import (
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeBroker records the subscriptions made at the broker.
+type fakeBroker struct {
+	mqtt.Client
+	connected bool
+
+	mu           sync.Mutex
+	subscribed   []string
+	unsubscribed []string
+	handlers     map[string]mqtt.MessageHandler
+}
+
+func (b *fakeBroker) IsConnectionOpen() bool { return b.connected }
+
+func (b *fakeBroker) Subscribe(topic string, _ byte, handler mqtt.MessageHandler) mqtt.Token {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subscribed = append(b.subscribed, topic)
+	b.handlers[topic] = handler
+	return doneToken{}
+}
+
+func (b *fakeBroker) Unsubscribe(topics ...string) mqtt.Token {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.unsubscribed = append(b.unsubscribed, topics...)
+	return doneToken{}
+}
+
+// deliver passes msg to the handler subscribed with filter.
+func (b *fakeBroker) deliver(filter string, msg fakeMessage) {
+	b.mu.Lock()
+	handler := b.handlers[filter]
+	b.mu.Unlock()
+
+	handler(b, msg)
+}
+
+type fakeMessage struct {
+	topic    string
+	payload  string
+	retained bool
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 0 }
+func (m fakeMessage) Retained() bool    { return m.retained }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return []byte(m.payload) }
+func (m fakeMessage) Ack()              {}
+
+// received records the messages handled by a device.
+type received struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (r *received) handler(_ mqtt.Client, msg mqtt.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m := string(msg.Payload())
+	if msg.Retained() {
+		m += " (retained)"
+	}
+	r.messages = append(r.messages, m)
+}
+
+func TestSubscriptionsRefcount(t *testing.T) {
+	tests := []struct {
+		name             string
+		connected        bool
+		run              func(s *Subscriptions, a, b *Client)
+		wantSubscribed   []string
+		wantUnsubscribed []string
+	}{
+		{
+			name:      "shared topic subscribed once",
+			connected: true,
+			run: func(s *Subscriptions, a, b *Client) {
+				a.Subscribe("fhem", 0, nil)
+				b.Subscribe("fhem", 0, nil)
+			},
+			wantSubscribed: []string{"fhem"},
+		},
+		{
+			name:      "shared topic kept while in use",
+			connected: true,
+			run: func(s *Subscriptions, a, b *Client) {
+				a.Subscribe("fhem", 0, nil)
+				b.Subscribe("fhem", 0, nil)
+				a.Close()
+			},
+			wantSubscribed: []string{"fhem"},
+		},
+		{
+			name:      "unused topic unsubscribed",
+			connected: true,
+			run: func(s *Subscriptions, a, b *Client) {
+				a.Subscribe("fhem", 0, nil)
+				b.Subscribe("fhem", 0, nil)
+				a.Close()
+				b.Close()
+			},
+			wantSubscribed:   []string{"fhem"},
+			wantUnsubscribed: []string{"fhem"},
+		},
+		{
+			name:      "single topic unsubscribed",
+			connected: true,
+			run: func(s *Subscriptions, a, b *Client) {
+				a.SubscribeMultiple(map[string]byte{"a/state": 0}, nil)
+				a.Subscribe("a/power", 0, nil)
+				a.Unsubscribe("a/power")
+				a.Unsubscribe()
+			},
+			wantSubscribed:   []string{"a/state", "a/power"},
+			wantUnsubscribed: []string{"a/power"},
+		},
+		{
+			name:      "subscribed again after unsubscribing",
+			connected: true,
+			run: func(s *Subscriptions, a, b *Client) {
+				a.Subscribe("fhem", 0, nil)
+				a.Close()
+				b.Subscribe("fhem", 0, nil)
+			},
+			wantSubscribed:   []string{"fhem", "fhem"},
+			wantUnsubscribed: []string{"fhem"},
+		},
+		{
+			name: "subscribed on connect",
+			run: func(s *Subscriptions, a, b *Client) {
+				a.Subscribe("fhem", 0, nil)
+				b.Subscribe("fhem", 0, nil)
+				s.client.(*fakeBroker).connected = true
+				s.Resubscribe()
+			},
+			wantSubscribed: []string{"fhem"},
+		},
+		{
+			name: "dropped while disconnected",
+			run: func(s *Subscriptions, a, b *Client) {
+				a.Subscribe("fhem", 0, nil)
+				a.Close()
+				s.client.(*fakeBroker).connected = true
+				s.Resubscribe()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := &fakeBroker{connected: tt.connected, handlers: map[string]mqtt.MessageHandler{}}
+			s := NewSubscriptions()
+			s.SetClient(broker)
+
+			tt.run(s, s.Client(nil), s.Client(nil))
+
+			if !reflect.DeepEqual(broker.subscribed, tt.wantSubscribed) {
+				t.Errorf("subscribed %v, want %v", broker.subscribed, tt.wantSubscribed)
+			}
+			if !reflect.DeepEqual(broker.unsubscribed, tt.wantUnsubscribed) {
+				t.Errorf("unsubscribed %v, want %v", broker.unsubscribed, tt.wantUnsubscribed)
+			}
+		})
+	}
+}
+
+func TestSubscriptionsReplay(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		before []fakeMessage // Delivered before the second device subscribes
+		closeA bool          // Closes the first device before the second subscribes
+		after  []fakeMessage
+		wantA  []string
+		wantB  []string // Replayed messages in any order, then the others
+	}{
+		{
+			name:   "no messages",
+			filter: "fhem",
+		},
+		{
+			name:   "last message replayed as retained",
+			filter: "fhem",
+			before: []fakeMessage{{"fhem", "offline", true}, {"fhem", "online", false}},
+			after:  []fakeMessage{{"fhem", "offline", false}},
+			wantA:  []string{"offline (retained)", "online", "offline"},
+			wantB:  []string{"online (retained)", "offline"},
+		},
+		{
+			name:   "last message per topic of a wildcard",
+			filter: "shellies/+/events/rpc",
+			before: []fakeMessage{{"shellies/a/events/rpc", "a1", false}, {"shellies/b/events/rpc", "b1", false}, {"shellies/a/events/rpc", "a2", false}},
+			wantA:  []string{"a1", "b1", "a2"},
+			wantB:  []string{"a2 (retained)", "b1 (retained)"},
+		},
+		{
+			name:   "forgotten once unsubscribed",
+			filter: "fhem",
+			before: []fakeMessage{{"fhem", "online", true}},
+			wantA:  []string{"online (retained)"},
+			closeA: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := &fakeBroker{connected: true, handlers: map[string]mqtt.MessageHandler{}}
+			s := NewSubscriptions()
+			s.SetClient(broker)
+
+			var a, b received
+			ca := s.Client(nil)
+			ca.Subscribe(tt.filter, 0, a.handler)
+			for _, m := range tt.before {
+				broker.deliver(tt.filter, m)
+			}
+			if tt.closeA {
+				ca.Close()
+			}
+			s.Client(nil).Subscribe(tt.filter, 0, b.handler)
+			for _, m := range tt.after {
+				broker.deliver(tt.filter, m)
+			}
+
+			if !reflect.DeepEqual(a.messages, tt.wantA) {
+				t.Errorf("first device received %q, want %q", a.messages, tt.wantA)
+			}
+			replayed := len(b.messages) - len(tt.after)
+			if replayed >= 0 {
+				slices.Sort(b.messages[:replayed])
+			}
+			if !reflect.DeepEqual(b.messages, tt.wantB) {
+				t.Errorf("second device received %q, want %q", b.messages, tt.wantB)
+			}
+		})
+	}
+}
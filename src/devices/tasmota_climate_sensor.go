@@ -2,11 +2,15 @@ package devices
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
 	"time"
 
 	"senhaerens.be/hap-mqtt/config"
+	eveservice "senhaerens.be/hap-mqtt/service"
 
 	"github.com/brutella/hap/accessory"
 	"github.com/brutella/hap/characteristic"
@@ -17,21 +21,95 @@ import (
 
 const (
 	CO2LevelsAbnormalThreshold = 1600
+	defaultCO2PeakWindow       = 24 * time.Hour
 )
 
-// Use pointer values so we can check for 'nil'
+// PM2.5 upper levels in µg/m³ of excellent, good, fair and inferior air quality
+var pm25AirQualityLevels = []float64{10, 20, 25, 50}
+
+// TcsSensor holds the measurements of the sensor blocks in a SENSOR
+// payload, e.g. {"BME280":{"Temperature":21.5,"Humidity":45.1}}.
 type TcsSensor struct {
-	*TcsBme280 `json:"BME280"`
-	*TcsMhz19b `json:"MHZ19B"`
+	Blocks map[string]map[string]float64
+	IDs    map[string]string // Block name by probe id, e.g. of DS18B20 probes
+}
+
+func (s *TcsSensor) UnmarshalJSON(data []byte) error {
+	var blocks map[string]json.RawMessage
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return err
+	}
+
+	s.Blocks = map[string]map[string]float64{}
+	s.IDs = map[string]string{}
+	for name, raw := range blocks {
+		// Skip fields which are no sensor block, e.g. Time and TempUnit
+		var fields map[string]interface{}
+		if json.Unmarshal(raw, &fields) != nil {
+			continue
+		}
+		values := map[string]float64{}
+		for key, v := range fields {
+			if f, ok := v.(float64); ok {
+				values[key] = f
+			}
+		}
+		s.Blocks[name] = values
+		if id, ok := fields["Id"].(string); ok {
+			s.IDs[id] = name
+		}
+	}
+
+	return nil
 }
 
-type TcsBme280 struct {
-	Temperature *float64 `json:"Temperature"`
-	Humidity    *float64 `json:"Humidity"`
+// value returns a measurement reported by the named block, or by the
+// first block reporting it in name order when block is empty.
+func (s TcsSensor) value(key string, block string) (float64, bool) {
+	if block != "" {
+		v, ok := s.Blocks[block][key]
+		return v, ok
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.Blocks)) {
+		if v, ok := s.Blocks[name][key]; ok {
+			return v, true
+		}
+	}
+	return 0, false
 }
 
-type TcsMhz19b struct {
-	CarbonDioxide *float64 `json:"CarbonDioxide"`
+// tcsMeasurements maps the measurements to their key in a sensor block.
+var tcsMeasurements = map[string]string{
+	"temperature": "Temperature",
+	"humidity":    "Humidity",
+	"co2":         "CarbonDioxide",
+	"light":       "Illuminance",
+	"pm25":        "PM2.5",
+	"pm10":        "PM10",
+	"pressure":    "Pressure",
+}
+
+func init() {
+	Register(Driver{
+		Key:         "tasmota_climate_sensors",
+		Description: "Tasmota climate sensor, e.g. BME280 with optional MHZ19B",
+		Options: []Option{
+			{Name: "noco2", Description: "Sensor has no CarbonDioxide detection", Values: []string{"noco2"}},
+		},
+		Offset: 200,
+		Settings: func() interface{} {
+			return &config.TasmotaClimateSensorSettings{}
+		},
+		New: func(id int, config config.Device) (Device, error) {
+			return NewTasmotaClimateSensor(id, config)
+		},
+	})
+}
+
+// tcsProbe is an additional temperature sensor, e.g. one of several DS18B20 probes.
+type tcsProbe struct {
+	*service.TemperatureSensor
+	config config.TasmotaProbe
 }
 
 type TasmotaClimateSensor struct {
@@ -41,16 +119,75 @@ type TasmotaClimateSensor struct {
 	*service.CarbonDioxideSensor
 	*characteristic.CarbonDioxideLevel
 	*characteristic.CarbonDioxidePeakLevel
+	*service.AirQualitySensor
+	*characteristic.PM2_5Density
+	*characteristic.PM10Density
+	*service.LightSensor
+	*eveservice.EveAirPressureSensor
+	Probes []*tcsProbe
+	*Reachability
+	History               *History
 	CarbonDioxidePeakTime time.Time
+	state                 StateStore
+	settings              config.TasmotaClimateSensorSettings
+	sensors               map[string]string // Measurement to sensor block, empty for any
 	config                config.Device
 }
 
-func NewTasmotaClimateSensor(id int, config config.Device) *TasmotaClimateSensor {
-	name := config.Name
+func NewTasmotaClimateSensor(id int, cfg config.Device) (*TasmotaClimateSensor, error) {
+	var settings config.TasmotaClimateSensorSettings
+	if err := cfg.Decode(&settings); err != nil {
+		return nil, err
+	}
+	if settings.CO2Threshold == 0 {
+		settings.CO2Threshold = CO2LevelsAbnormalThreshold
+	}
+	if settings.CO2PeakWindow == 0 {
+		settings.CO2PeakWindow = defaultCO2PeakWindow
+	}
+
+	probes := map[string]bool{}
+	for i, p := range settings.Probes {
+		if (p.Block == "") == (p.ID == "") {
+			return nil, fmt.Errorf("probe %d: set either block or id", i)
+		}
+		if p.Name == "" {
+			return nil, fmt.Errorf("probe %d: name is missing", i)
+		}
+		key := p.Block + "/" + p.ID
+		if probes[key] {
+			return nil, fmt.Errorf("probe %d: duplicate probe", i)
+		}
+		probes[key] = true
+	}
+
+	sensors := settings.Sensors
+	if len(sensors) == 0 {
+		sensors = map[string]string{"temperature": "", "humidity": "", "co2": ""}
+	}
+	for m := range sensors {
+		if _, ok := tcsMeasurements[m]; !ok {
+			return nil, fmt.Errorf("unknown measurement %q, expected one of %s", m, strings.Join(slices.Sorted(maps.Keys(tcsMeasurements)), ", "))
+		}
+	}
+	if len(cfg.Options) > 0 && cfg.Options[0] == "noco2" {
+		sensors = maps.Clone(sensors)
+		delete(sensors, "co2")
+	}
+	if n := len(settings.AirQuality); n > 0 {
+		if n != 4 || !slices.IsSorted(settings.AirQuality) {
+			return nil, errors.New("air_quality must list 4 ascending CO2 levels")
+		}
+		if _, ok := sensors["co2"]; !ok {
+			return nil, errors.New("air_quality requires CO2 detection")
+		}
+	}
+
+	name := cfg.Name
 	model := "Climate Sensor"
-	if config.FriendlyName != "" {
-		name = config.FriendlyName
-		model = fmt.Sprintf("%s (%s)", model, config.Name)
+	if cfg.FriendlyName != "" {
+		name = cfg.FriendlyName
+		model = fmt.Sprintf("%s (%s)", model, cfg.Name)
 	}
 
 	a := TasmotaClimateSensor{}
@@ -60,15 +197,21 @@ func NewTasmotaClimateSensor(id int, config config.Device) *TasmotaClimateSensor
 		Manufacturer: "Tasmota",
 	}, accessory.TypeSensor)
 	a.Id = uint64(id)
-	log.Infof("HAP Create Accessory %4d - %s", a.Id, config.Name)
+	log.Infof("HAP Create Accessory %4d - %s", a.Id, cfg.Name)
 
-	a.TemperatureSensor = service.NewTemperatureSensor()
-	a.AddS(a.TemperatureSensor.S)
+	if _, ok := sensors["temperature"]; ok {
+		a.TemperatureSensor = service.NewTemperatureSensor()
+		// Allow outdoor and freezer probes
+		a.CurrentTemperature.SetMinValue(-50)
+		a.AddS(a.TemperatureSensor.S)
+	}
 
-	a.HumiditySensor = service.NewHumiditySensor()
-	a.AddS(a.HumiditySensor.S)
+	if _, ok := sensors["humidity"]; ok {
+		a.HumiditySensor = service.NewHumiditySensor()
+		a.AddS(a.HumiditySensor.S)
+	}
 
-	if len(config.Options) == 0 || config.Options[0] != "noco2" {
+	if _, ok := sensors["co2"]; ok {
 		a.CarbonDioxideSensor = service.NewCarbonDioxideSensor()
 
 		a.CarbonDioxideLevel = characteristic.NewCarbonDioxideLevel()
@@ -79,17 +222,88 @@ func NewTasmotaClimateSensor(id int, config config.Device) *TasmotaClimateSensor
 		a.CarbonDioxidePeakTime = time.Now()
 
 		a.AddS(a.CarbonDioxideSensor.S)
+
+	}
+
+	_, pm25 := sensors["pm25"]
+	_, pm10 := sensors["pm10"]
+	if len(settings.AirQuality) > 0 || pm25 || pm10 {
+		a.AirQualitySensor = service.NewAirQualitySensor()
+		if pm25 {
+			a.PM2_5Density = characteristic.NewPM2_5Density()
+			a.AirQualitySensor.AddC(a.PM2_5Density.C)
+		}
+		if pm10 {
+			a.PM10Density = characteristic.NewPM10Density()
+			a.AirQualitySensor.AddC(a.PM10Density.C)
+		}
+		a.AddS(a.AirQualitySensor.S)
 	}
 
-	a.config = config
+	if _, ok := sensors["light"]; ok {
+		a.LightSensor = service.NewLightSensor()
+		a.AddS(a.LightSensor.S)
+	}
 
-	return &a
+	if _, ok := sensors["pressure"]; ok {
+		a.EveAirPressureSensor = eveservice.NewEveAirPressureSensor()
+		a.AddS(a.EveAirPressureSensor.S)
+	}
+
+	for _, pc := range settings.Probes {
+		p := &tcsProbe{TemperatureSensor: service.NewTemperatureSensor(), config: pc}
+		p.CurrentTemperature.SetMinValue(-50)
+		name := characteristic.NewName()
+		name.SetValue(pc.Name)
+		p.AddC(name.C)
+		a.AddS(p.S)
+		a.Probes = append(a.Probes, p)
+	}
+
+	a.Reachability = newReachability(a.A, cfg)
+	a.settings = settings
+	a.sensors = sensors
+	a.config = cfg
+
+	// Added after the reachability guard, the Eve app reads it while offline
+	if a.TemperatureSensor != nil && a.HumiditySensor != nil {
+		kind := historyRoom
+		if a.CarbonDioxideSensor == nil {
+			kind = historyWeather
+		}
+		a.History = newHistory(kind)
+		a.AddS(a.History.S)
+	}
+
+	return &a, nil
 }
 
 func (a *TasmotaClimateSensor) Accessory() *accessory.A {
 	return a.A
 }
 
+// Temperature returns the measured temperature, nil when not exposed.
+func (a *TasmotaClimateSensor) Temperature() *characteristic.CurrentTemperature {
+	if a.TemperatureSensor == nil {
+		return nil
+	}
+	return a.TemperatureSensor.CurrentTemperature
+}
+
+// RestoreState keeps the CO2 peak window running and the Eve history
+// across restarts.
+func (a *TasmotaClimateSensor) RestoreState(state StateStore) {
+	a.state = state
+	if a.History != nil {
+		a.History.restore(state)
+	}
+
+	var peakTime time.Time
+	if a.CarbonDioxideSensor != nil && state.Get("co2_peak_time", &peakTime) {
+		a.CarbonDioxidePeakTime = peakTime
+	}
+}
+
 func (a *TasmotaClimateSensor) Listen(client mqtt.Client) {
 	// MQTT -> HAP
 	subLwt := fmt.Sprintf("tele/%s/LWT", a.config.Name)
@@ -98,9 +312,7 @@ func (a *TasmotaClimateSensor) Listen(client mqtt.Client) {
 		payload := string(msg.Payload())
 		log.Debugf("MQTT received %s from %s", payload, msg.Topic())
 
-		if strings.ToLower(payload) == "offline" {
-			log.Infof("MQTT %s is offline", a.config.Name)
-		}
+		a.SetOnline(strings.ToLower(payload) != "offline")
 	})
 
 	subSensor := fmt.Sprintf("tele/%s/SENSOR", a.config.Name)
@@ -114,35 +326,138 @@ func (a *TasmotaClimateSensor) Listen(client mqtt.Client) {
 			log.Error("Failed to decode JSON payload", "err", err)
 			return
 		}
-		// log.Debugf("%+v", sensor)
+		a.update(sensor)
+	})
+
+	// Response to RequestState
+	subStatus := fmt.Sprintf("stat/%s/STATUS10", a.config.Name)
+	client.Subscribe(subStatus, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		msg.Ack()
+		log.Debugf("MQTT received %s from %s", msg.Payload(), msg.Topic())
 
-		// Temperature & Humidity sensor
-		if sensor.Temperature == nil || sensor.Humidity == nil {
-			log.Error("BME280 sensor data is missing")
+		var status struct {
+			StatusSNS TcsSensor `json:"StatusSNS"`
+		}
+		err := json.Unmarshal(msg.Payload(), &status)
+		if err != nil {
+			log.Error("Failed to decode JSON payload", "err", err)
 			return
 		}
-		a.CurrentTemperature.SetValue(*sensor.Temperature)
-		a.CurrentRelativeHumidity.SetValue(*sensor.Humidity)
+		a.update(status.StatusSNS)
+	})
+}
 
-		// CarbonDioxide sensor
-		if (len(a.config.Options) > 0 && a.config.Options[0] == "noco2") || sensor.CarbonDioxide == nil {
-			return
+// RequestState asks Tasmota to publish its sensor status.
+func (a *TasmotaClimateSensor) RequestState(client mqtt.Client) {
+	pubStatus := fmt.Sprintf("cmnd/%s/STATUS", a.config.Name)
+	payload := "10"
+	a.publish(client, pubStatus, payload)
+}
+
+func (a *TasmotaClimateSensor) update(sensor TcsSensor) {
+	found := 0
+	value := func(m string) (float64, bool) {
+		block, ok := a.sensors[m]
+		if !ok {
+			return 0, false
+		}
+		v, ok := sensor.value(tcsMeasurements[m], block)
+		if ok {
+			found++
+		}
+		return v, ok
+	}
+
+	temperature, hasTemperature := value("temperature")
+	if hasTemperature {
+		a.CurrentTemperature.SetValue(temperature)
+	}
+	humidity, hasHumidity := value("humidity")
+	if hasHumidity {
+		a.CurrentRelativeHumidity.SetValue(humidity)
+	}
+	if v, ok := value("light"); ok {
+		a.CurrentAmbientLightLevel.SetValue(v)
+	}
+	if v, ok := value("pressure"); ok {
+		a.AirPressure.SetValue(v)
+	}
+
+	quality := characteristic.AirQualityUnknown
+	if v, ok := value("pm25"); ok {
+		a.PM2_5Density.SetValue(v)
+		quality = airQuality(v, pm25AirQualityLevels)
+	}
+	if v, ok := value("pm10"); ok {
+		a.PM10Density.SetValue(v)
+	}
+
+	// CarbonDioxide sensor
+	co2, hasCO2 := value("co2")
+	if hasCO2 {
+		a.updateCO2(co2)
+		if len(a.settings.AirQuality) > 0 {
+			quality = max(quality, airQuality(co2, a.settings.AirQuality))
 		}
+	}
+
+	if a.AirQualitySensor != nil && quality != characteristic.AirQualityUnknown {
+		a.AirQuality.SetValue(quality)
+	}
+
+	for _, p := range a.Probes {
+		block := p.config.Block
+		if p.config.ID != "" {
+			block = sensor.IDs[p.config.ID]
+		}
+		if v, ok := sensor.value("Temperature", block); ok && block != "" {
+			p.CurrentTemperature.SetValue(v)
+			found++
+		}
+	}
 
-		if *sensor.CarbonDioxide > CO2LevelsAbnormalThreshold {
-			a.CarbonDioxideDetected.SetValue(characteristic.CarbonDioxideDetectedCO2LevelsAbnormal)
-		} else {
-			a.CarbonDioxideDetected.SetValue(characteristic.CarbonDioxideDetectedCO2LevelsNormal)
+	if found == 0 {
+		log.Error("Sensor data is missing", "device", a.config.Name, "blocks", slices.Sorted(maps.Keys(sensor.Blocks)))
+		return
+	}
+
+	if a.History != nil && hasTemperature && hasHumidity {
+		if a.CarbonDioxideSensor == nil {
+			a.History.add(temperature, humidity)
+		} else if hasCO2 {
+			a.History.add(temperature, humidity, co2)
 		}
+	}
+}
 
-		// Reset PeakLevel every 24 hours & only update if current value is higher
-		if time.Since(a.CarbonDioxidePeakTime) >= time.Hour*24 {
-			a.CarbonDioxidePeakTime = time.Now()
-			a.CarbonDioxidePeakLevel.SetValue(*sensor.CarbonDioxide)
-		} else if *sensor.CarbonDioxide > a.CarbonDioxidePeakLevel.Value() {
-			a.CarbonDioxidePeakLevel.SetValue(*sensor.CarbonDioxide)
+func (a *TasmotaClimateSensor) updateCO2(co2 float64) {
+	if co2 > a.settings.CO2Threshold {
+		a.CarbonDioxideDetected.SetValue(characteristic.CarbonDioxideDetectedCO2LevelsAbnormal)
+	} else {
+		a.CarbonDioxideDetected.SetValue(characteristic.CarbonDioxideDetectedCO2LevelsNormal)
+	}
+
+	// Reset PeakLevel every peak window & only update if current value is higher
+	if time.Since(a.CarbonDioxidePeakTime) >= a.settings.CO2PeakWindow {
+		a.CarbonDioxidePeakTime = time.Now()
+		if a.state != nil {
+			a.state.Set("co2_peak_time", a.CarbonDioxidePeakTime)
 		}
+		a.CarbonDioxidePeakLevel.SetValue(co2)
+	} else if co2 > a.CarbonDioxidePeakLevel.Value() {
+		a.CarbonDioxidePeakLevel.SetValue(co2)
+	}
 
-		a.CarbonDioxideLevel.SetValue(*sensor.CarbonDioxide)
-	})
+	a.CarbonDioxideLevel.SetValue(co2)
+}
+
+// airQuality maps a measurement, e.g. a CO2 or PM2.5 level, to excellent,
+// good, fair, inferior or poor, by the upper levels of the first four.
+func airQuality(v float64, levels []float64) int {
+	for i, level := range levels {
+		if v <= level {
+			return characteristic.AirQualityExcellent + i
+		}
+	}
+	return characteristic.AirQualityPoor
 }
@@ -1,29 +1,140 @@
 package devices
 
 import (
+	"encoding/json"
 	"fmt"
+	"maps"
+	"net/http"
+	"slices"
 	"strings"
 
+	eve "senhaerens.be/hap-mqtt/characteristic"
 	"senhaerens.be/hap-mqtt/config"
 
 	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
 	"github.com/brutella/hap/service"
 	"github.com/charmbracelet/log"
 	"github.com/eclipse/paho.mqtt.golang"
 )
 
+func init() {
+	Register(Driver{
+		Key:         "tasmota_plugs",
+		Description: "Tasmota plug",
+		Options: []Option{
+			{Name: "output", Description: "Output of a Tasmota device with multiple outputs (default POWER)"},
+		},
+		Offset:  2,
+		Confirm: true,
+		Settings: func() interface{} {
+			return &config.TasmotaPlugSettings{}
+		},
+		New: func(id int, config config.Device) (Device, error) {
+			return NewTasmotaPlug(id, config)
+		},
+	})
+}
+
+// tasmotaPower is a HomeKit service switching a Tasmota power output.
+type tasmotaPower struct {
+	Service     *service.S
+	On          *characteristic.On
+	OutletInUse *characteristic.OutletInUse // Outlet service only
+}
+
+// tasmotaPowerServices maps the service setting to the accessory category
+// and the service constructor.
+var tasmotaPowerServices = map[string]struct {
+	category byte
+	new      func() tasmotaPower
+}{
+	"lightbulb": {accessory.TypeLightbulb, func() tasmotaPower {
+		s := service.NewLightbulb()
+		return tasmotaPower{Service: s.S, On: s.On}
+	}},
+	"outlet": {accessory.TypeOutlet, func() tasmotaPower {
+		s := service.NewOutlet()
+		return tasmotaPower{Service: s.S, On: s.On, OutletInUse: s.OutletInUse}
+	}},
+	"switch": {accessory.TypeSwitch, func() tasmotaPower {
+		s := service.NewSwitch()
+		return tasmotaPower{Service: s.S, On: s.On}
+	}},
+	"fan": {accessory.TypeFan, func() tasmotaPower {
+		s := service.NewFan()
+		return tasmotaPower{Service: s.S, On: s.On}
+	}},
+}
+
+// newTasmotaPower creates the service named svc, a lightbulb by default,
+// and returns it with the matching accessory category.
+func newTasmotaPower(svc string) (tasmotaPower, byte, error) {
+	if svc == "" {
+		svc = "lightbulb"
+	}
+	s, ok := tasmotaPowerServices[svc]
+	if !ok {
+		names := strings.Join(slices.Sorted(maps.Keys(tasmotaPowerServices)), ", ")
+		return tasmotaPower{}, 0, fmt.Errorf("unknown service %q, expected one of %s", svc, names)
+	}
+
+	return s.new(), s.category, nil
+}
+
+// inUseWhileOn marks an outlet as in use while it is on, for outputs
+// without power readings.
+func (p tasmotaPower) inUseWhileOn() {
+	if p.OutletInUse == nil {
+		return
+	}
+	p.On.OnValueUpdate(func(new, _ bool, _ *http.Request) {
+		p.OutletInUse.SetValue(new)
+	})
+}
+
+// Use pointer values so we can check for 'nil'
+type TpSensor struct {
+	*TpEnergy `json:"ENERGY"`
+}
+
+type TpEnergy struct {
+	Power   *float64 `json:"Power"`
+	Voltage *float64 `json:"Voltage"`
+	Current *float64 `json:"Current"`
+	Total   *float64 `json:"Total"`
+}
+
 type TasmotaPlug struct {
 	*accessory.A
-	*service.Lightbulb
-	config config.Device
+	tasmotaPower
+	// Energy readings, nil unless enabled
+	Power            *eve.EvePower
+	Voltage          *eve.EveVoltage
+	Current          *eve.EveCurrent
+	TotalConsumption *eve.EveTotalConsumption
+	History          *History
+	*Reachability
+	client   mqtt.Client
+	settings config.TasmotaPlugSettings
+	config   config.Device
 }
 
-func NewTasmotaPlug(id int, config config.Device) *TasmotaPlug {
-	name := config.Name
+func NewTasmotaPlug(id int, cfg config.Device) (*TasmotaPlug, error) {
+	var settings config.TasmotaPlugSettings
+	if err := cfg.Decode(&settings); err != nil {
+		return nil, err
+	}
+	power, category, err := newTasmotaPower(settings.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	name := cfg.Name
 	model := "Plug"
-	if config.FriendlyName != "" {
-		name = config.FriendlyName
-		model = fmt.Sprintf("%s (%s)", model, config.Name)
+	if cfg.FriendlyName != "" {
+		name = cfg.FriendlyName
+		model = fmt.Sprintf("%s (%s)", model, cfg.Name)
 	}
 
 	a := TasmotaPlug{}
@@ -31,28 +142,60 @@ func NewTasmotaPlug(id int, config config.Device) *TasmotaPlug {
 		Name:         name,
 		Model:        model,
 		Manufacturer: "Tasmota",
-	}, accessory.TypeLightbulb)
+	}, category)
 	a.Id = uint64(id)
-	log.Infof("HAP Create Accessory %4d - %s", a.Id, config.Name)
+	log.Infof("HAP Create Accessory %4d - %s", a.Id, cfg.Name)
+
+	a.tasmotaPower = power
+	a.AddS(a.Service)
 
-	a.Lightbulb = service.NewLightbulb()
-	a.AddS(a.Lightbulb.S)
+	if settings.Energy {
+		a.Power = eve.NewEvePower()
+		a.Service.AddC(a.Power.C)
+		a.Voltage = eve.NewEveVoltage()
+		a.Service.AddC(a.Voltage.C)
+		a.Current = eve.NewEveCurrent()
+		a.Service.AddC(a.Current.C)
+		a.TotalConsumption = eve.NewEveTotalConsumption()
+		a.Service.AddC(a.TotalConsumption.C)
+	} else {
+		a.inUseWhileOn()
+	}
 
-	a.config = config
+	a.Reachability = newReachability(a.A, cfg)
+	a.settings = settings
+	a.config = cfg
 
-	return &a
+	// Added after the reachability guard, the Eve app reads it while offline
+	if settings.Energy {
+		a.History = newHistory(historyEnergy)
+		a.AddS(a.History.S)
+	}
+
+	return &a, nil
 }
 
 func (a *TasmotaPlug) Accessory() *accessory.A {
 	return a.A
 }
 
-func (a *TasmotaPlug) Listen(client mqtt.Client) {
-	// for Tasmota devices which have multiple outputs
-	output := "POWER"
+// RestoreState keeps the Eve power history across restarts.
+func (a *TasmotaPlug) RestoreState(state StateStore) {
+	if a.History != nil {
+		a.History.restore(state)
+	}
+}
+
+// for Tasmota devices which have multiple outputs
+func (a *TasmotaPlug) output() string {
 	if len(a.config.Options) > 0 && a.config.Options[0] != "" {
-		output = a.config.Options[0]
+		return a.config.Options[0]
 	}
+	return "POWER"
+}
+
+func (a *TasmotaPlug) Listen(client mqtt.Client) {
+	output := a.output()
 
 	// MQTT -> HAP
 	subLwt := fmt.Sprintf("tele/%s/LWT", a.config.Name)
@@ -61,9 +204,7 @@ func (a *TasmotaPlug) Listen(client mqtt.Client) {
 		payload := string(msg.Payload())
 		log.Debugf("MQTT received %s from %s", payload, msg.Topic())
 
-		if strings.ToLower(payload) == "offline" {
-			log.Infof("MQTT %s is offline", a.config.Name)
-		}
+		a.SetOnline(strings.ToLower(payload) != "offline")
 	})
 
 	subPower := fmt.Sprintf("stat/%s/%s", a.config.Name, output)
@@ -74,21 +215,99 @@ func (a *TasmotaPlug) Listen(client mqtt.Client) {
 
 		switch payload {
 		case "ON":
-			a.On.SetValue(true)
+			a.report(a.On.C, true)
 		case "OFF":
-			a.On.SetValue(false)
+			a.report(a.On.C, false)
 		}
 	})
 
+	if a.settings.Energy {
+		subSensor := fmt.Sprintf("tele/%s/SENSOR", a.config.Name)
+		client.Subscribe(subSensor, 1, func(_ mqtt.Client, msg mqtt.Message) {
+			msg.Ack()
+			log.Debugf("MQTT received %s from %s", msg.Payload(), msg.Topic())
+			var sensor TpSensor
+			err := json.Unmarshal(msg.Payload(), &sensor)
+			if err != nil {
+				log.Error("Failed to decode JSON payload", "err", err)
+				return
+			}
+			a.update(sensor)
+		})
+
+		subStatus := fmt.Sprintf("stat/%s/STATUS10", a.config.Name)
+		client.Subscribe(subStatus, 1, func(_ mqtt.Client, msg mqtt.Message) {
+			msg.Ack()
+			log.Debugf("MQTT received %s from %s", msg.Payload(), msg.Topic())
+			var status struct {
+				StatusSNS TpSensor `json:"StatusSNS"`
+			}
+			err := json.Unmarshal(msg.Payload(), &status)
+			if err != nil {
+				log.Error("Failed to decode JSON payload", "err", err)
+				return
+			}
+			a.update(status.StatusSNS)
+		})
+	}
+
 	// HAP -> MQTT
-	pubPower := fmt.Sprintf("cmnd/%s/%s", a.config.Name, output)
-	a.On.OnValueRemoteUpdate(func(on bool) {
-		payload := "OFF"
-		if on == true {
-			payload = "ON"
+	a.client = client
+	onCommand(a.Reachability, a.On.C, a.switchPower)
+}
+
+func (a *TasmotaPlug) switchPower(on bool) {
+	pubPower := fmt.Sprintf("cmnd/%s/%s", a.config.Name, a.output())
+	payload := "OFF"
+	if on == true {
+		payload = "ON"
+	}
+	a.command(a.client, a.On.C, on, pubPower, payload)
+}
+
+// PowerOn returns the power state of the output.
+func (a *TasmotaPlug) PowerOn() *characteristic.On {
+	return a.On
+}
+
+// SwitchPower switches the output on behalf of another device, e.g. a thermostat.
+func (a *TasmotaPlug) SwitchPower(on bool) {
+	a.On.SetValue(on)
+	a.switchPower(on)
+}
+
+// RequestState publishes an empty command, which Tasmota answers with the
+// power state, and asks for the energy readings when enabled.
+func (a *TasmotaPlug) RequestState(client mqtt.Client) {
+	pubPower := fmt.Sprintf("cmnd/%s/%s", a.config.Name, a.output())
+	a.publish(client, pubPower, "")
+
+	if a.settings.Energy {
+		pubStatus := fmt.Sprintf("cmnd/%s/STATUS", a.config.Name)
+		a.publish(client, pubStatus, "10")
+	}
+}
+
+func (a *TasmotaPlug) update(sensor TpSensor) {
+	if sensor.TpEnergy == nil {
+		return
+	}
+
+	if sensor.Power != nil {
+		a.Power.SetValue(*sensor.Power)
+		a.History.add(*sensor.Power)
+		// An outlet is in use while it draws more than the threshold
+		if a.OutletInUse != nil {
+			a.OutletInUse.SetValue(*sensor.Power > a.settings.InUseThreshold)
 		}
-		token := client.Publish(pubPower, 1, false, payload)
-		token.Wait()
-		log.Debugf("MQTT published %s to %s", payload, pubPower)
-	})
+	}
+	if sensor.Voltage != nil {
+		a.Voltage.SetValue(*sensor.Voltage)
+	}
+	if sensor.Current != nil {
+		a.Current.SetValue(*sensor.Current)
+	}
+	if sensor.Total != nil {
+		a.TotalConsumption.SetValue(*sensor.Total)
+	}
 }
@@ -0,0 +1,173 @@
+package devices
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"senhaerens.be/hap-mqtt/config"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/charmbracelet/log"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+func init() {
+	Register(Driver{
+		Key:         "tasmota_relays",
+		Description: "Tasmota device with multiple relays",
+		Confirm:     true,
+		Settings: func() interface{} {
+			return &config.TasmotaRelaySettings{}
+		},
+		New: func(id int, config config.Device) (Device, error) {
+			return NewTasmotaRelay(id, config)
+		},
+	})
+}
+
+type tasmotaRelayChannel struct {
+	tasmotaPower
+	config config.TasmotaRelayChannel
+}
+
+type TasmotaRelay struct {
+	*accessory.A
+	Channels []*tasmotaRelayChannel
+	*Reachability
+	config config.Device
+}
+
+func NewTasmotaRelay(id int, cfg config.Device) (*TasmotaRelay, error) {
+	var settings config.TasmotaRelaySettings
+	if err := cfg.Decode(&settings); err != nil {
+		return nil, err
+	}
+	if len(settings.Channels) == 0 {
+		return nil, errors.New("no channels")
+	}
+
+	var channels []*tasmotaRelayChannel
+	var category byte
+	outputs := map[string]bool{}
+	for i, cc := range settings.Channels {
+		if cc.Output == "" {
+			return nil, fmt.Errorf("channel %d: output is missing", i)
+		}
+		if outputs[cc.Output] {
+			return nil, fmt.Errorf("channel %d: duplicate output %s", i, cc.Output)
+		}
+		outputs[cc.Output] = true
+
+		power, c, err := newTasmotaPower(cc.Service)
+		if err != nil {
+			return nil, fmt.Errorf("channel %d: %w", i, err)
+		}
+		// The first channel determines the accessory category
+		if i == 0 {
+			category = c
+		}
+
+		name := characteristic.NewName()
+		name.SetValue(cc.Output)
+		if cc.Name != "" {
+			name.SetValue(cc.Name)
+		}
+		power.Service.AddC(name.C)
+		power.inUseWhileOn()
+
+		channels = append(channels, &tasmotaRelayChannel{tasmotaPower: power, config: cc})
+	}
+
+	name := cfg.Name
+	model := "Relay"
+	if cfg.FriendlyName != "" {
+		name = cfg.FriendlyName
+		model = fmt.Sprintf("%s (%s)", model, cfg.Name)
+	}
+
+	a := TasmotaRelay{}
+	a.A = accessory.New(accessory.Info{
+		Name:         name,
+		Model:        model,
+		Manufacturer: "Tasmota",
+	}, category)
+	a.Id = uint64(id)
+	log.Infof("HAP Create Accessory %4d - %s", a.Id, cfg.Name)
+
+	// The first channel is the primary service, linked to the others
+	for i, ch := range channels {
+		a.AddS(ch.Service)
+		if i == 0 {
+			ch.Service.Primary = true
+			continue
+		}
+		channels[0].Service.AddS(ch.Service)
+	}
+	a.Channels = channels
+
+	a.Reachability = newReachability(a.A, cfg)
+	a.config = cfg
+
+	return &a, nil
+}
+
+func (a *TasmotaRelay) Accessory() *accessory.A {
+	return a.A
+}
+
+func (a *TasmotaRelay) Listen(client mqtt.Client) {
+	// MQTT -> HAP
+	subLwt := fmt.Sprintf("tele/%s/LWT", a.config.Name)
+	client.Subscribe(subLwt, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		msg.Ack()
+		payload := string(msg.Payload())
+		log.Debugf("MQTT received %s from %s", payload, msg.Topic())
+
+		a.SetOnline(strings.ToLower(payload) != "offline")
+	})
+
+	// Both carry the power state of all outputs, e.g. {"POWER1":"ON","POWER2":"OFF"}
+	subResult := fmt.Sprintf("stat/%s/RESULT", a.config.Name)
+	subState := fmt.Sprintf("tele/%s/STATE", a.config.Name)
+	client.SubscribeMultiple(map[string]byte{subResult: 1, subState: 1}, func(_ mqtt.Client, msg mqtt.Message) {
+		msg.Ack()
+		log.Debugf("MQTT received %s from %s", msg.Payload(), msg.Topic())
+
+		var state map[string]interface{}
+		if err := json.Unmarshal(msg.Payload(), &state); err != nil {
+			log.Error("Failed to decode JSON payload", "err", err)
+			return
+		}
+
+		for _, ch := range a.Channels {
+			switch state[ch.config.Output] {
+			case "ON":
+				a.report(ch.On.C, true)
+			case "OFF":
+				a.report(ch.On.C, false)
+			}
+		}
+	})
+
+	// HAP -> MQTT
+	for _, ch := range a.Channels {
+		pubPower := fmt.Sprintf("cmnd/%s/%s", a.config.Name, ch.config.Output)
+		onCommand(a.Reachability, ch.On.C, func(on bool) {
+			payload := "OFF"
+			if on {
+				payload = "ON"
+			}
+			a.command(client, ch.On.C, on, pubPower, payload)
+		})
+	}
+}
+
+// RequestState publishes an empty STATE command, which Tasmota answers
+// with the power state of all outputs on the RESULT topic.
+func (a *TasmotaRelay) RequestState(client mqtt.Client) {
+	pubState := fmt.Sprintf("cmnd/%s/STATE", a.config.Name)
+	a.publish(client, pubState, "")
+}
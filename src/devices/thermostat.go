@@ -0,0 +1,290 @@
+package devices
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"senhaerens.be/hap-mqtt/config"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/charmbracelet/log"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	defaultHysteresis     = 0.3
+	defaultTargetTemp     = 20
+	thermostatCheckPeriod = 30 * time.Second // Re-evaluates e.g. after the minimum on or off time
+	thermostatSwitchedKey = "switched"
+)
+
+func init() {
+	Register(Driver{
+		Key:         "thermostats",
+		Description: "Software thermostat switching a heater by a temperature sensor",
+		Settings: func() interface{} {
+			return &config.ThermostatSettings{}
+		},
+		New: func(id int, config config.Device) (Device, error) {
+			return NewThermostat(id, config)
+		},
+	})
+}
+
+// TemperatureSource is a device measuring a temperature, e.g. a Tasmota
+// climate sensor.
+type TemperatureSource interface {
+	Temperature() *characteristic.CurrentTemperature
+	Online() bool
+}
+
+// PowerSwitch is a device switching a power output, e.g. a Tasmota plug.
+type PowerSwitch interface {
+	PowerOn() *characteristic.On
+	SwitchPower(on bool)
+	Online() bool
+}
+
+// Thermostat switches a heater to keep the temperature measured by a
+// sensor at the target temperature. Heating starts below the target minus
+// the hysteresis and stops above the target plus the hysteresis.
+type Thermostat struct {
+	*accessory.A
+	*service.Thermostat
+	*Reachability
+	sensor TemperatureSource
+	heater PowerSwitch
+
+	mu       sync.Mutex
+	measured bool      // The sensor measured a temperature since the thermostat was created
+	switched time.Time // Last time the heater was switched by the thermostat
+	state    StateStore
+	stop     chan struct{}
+	settings config.ThermostatSettings
+	config   config.Device
+}
+
+func NewThermostat(id int, cfg config.Device) (*Thermostat, error) {
+	var settings config.ThermostatSettings
+	if err := cfg.Decode(&settings); err != nil {
+		return nil, err
+	}
+	if settings.Sensor == "" || settings.Heater == "" {
+		return nil, fmt.Errorf("sensor and heater are required")
+	}
+	if settings.Hysteresis < 0 || settings.MinOnTime < 0 || settings.MinOffTime < 0 {
+		return nil, fmt.Errorf("hysteresis, min_on_time and min_off_time must not be negative")
+	}
+	if settings.Hysteresis == 0 {
+		settings.Hysteresis = defaultHysteresis
+	}
+
+	name := cfg.Name
+	model := "Thermostat"
+	if cfg.FriendlyName != "" {
+		name = cfg.FriendlyName
+		model = fmt.Sprintf("%s (%s)", model, cfg.Name)
+	}
+
+	a := Thermostat{}
+	a.A = accessory.New(accessory.Info{
+		Name:         name,
+		Model:        model,
+		Manufacturer: "hap-mqtt",
+	}, accessory.TypeThermostat)
+	a.Id = uint64(id)
+	log.Infof("HAP Create Accessory %4d - %s", a.Id, cfg.Name)
+
+	a.Thermostat = service.NewThermostat()
+	a.CurrentTemperature.SetMinValue(-50)
+	a.TargetTemperature.SetValue(defaultTargetTemp)
+	// Heating only, auto heats like heat
+	a.TargetHeatingCoolingState.ValidVals = []int{
+		characteristic.TargetHeatingCoolingStateOff,
+		characteristic.TargetHeatingCoolingStateHeat,
+		characteristic.TargetHeatingCoolingStateAuto,
+	}
+	a.CurrentHeatingCoolingState.ValidVals = []int{
+		characteristic.CurrentHeatingCoolingStateOff,
+		characteristic.CurrentHeatingCoolingStateHeat,
+	}
+	a.AddS(a.Thermostat.S)
+
+	a.Reachability = newReachability(a.A, cfg)
+	a.stop = make(chan struct{})
+	a.settings = settings
+	a.config = cfg
+
+	return &a, nil
+}
+
+func (a *Thermostat) Accessory() *accessory.A {
+	return a.A
+}
+
+// Listen subscribes to nothing, the thermostat follows the linked devices.
+func (a *Thermostat) Listen(_ mqtt.Client) {}
+
+// Link looks up the sensor and the heater and starts controlling the heater.
+func (a *Thermostat) Link(lookup func(name string) []Device) error {
+	for _, d := range lookup(a.settings.Sensor) {
+		if s, ok := d.(TemperatureSource); ok && s.Temperature() != nil {
+			a.sensor = s
+		}
+	}
+	if a.sensor == nil {
+		return fmt.Errorf("no temperature sensor %q", a.settings.Sensor)
+	}
+	for _, d := range lookup(a.settings.Heater) {
+		if h, ok := d.(PowerSwitch); ok {
+			a.heater = h
+		}
+	}
+	if a.heater == nil {
+		return fmt.Errorf("no heater %q", a.settings.Heater)
+	}
+
+	temperature := a.sensor.Temperature()
+	a.CurrentTemperature.SetValue(temperature.Value())
+	temperature.OnValueUpdate(func(new, _ float64, _ *http.Request) {
+		a.CurrentTemperature.SetValue(new)
+		a.mu.Lock()
+		a.measured = true
+		a.mu.Unlock()
+		a.evaluate()
+	})
+
+	a.heating(a.heater.PowerOn().Value())
+	a.heater.PowerOn().OnValueUpdate(func(new, _ bool, _ *http.Request) {
+		a.heating(new)
+	})
+
+	a.TargetTemperature.OnValueUpdate(func(_, _ float64, _ *http.Request) {
+		a.evaluate()
+	})
+	a.TargetHeatingCoolingState.OnValueUpdate(func(new, _ int, _ *http.Request) {
+		if new == characteristic.TargetHeatingCoolingStateOff {
+			a.switchOff()
+		}
+		a.evaluate()
+	})
+
+	go a.run()
+
+	return nil
+}
+
+// RestoreState keeps the minimum on and off times across restarts and
+// reloads. The first measurement is not kept, a restored temperature may be
+// stale.
+func (a *Thermostat) RestoreState(state StateStore) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.state = state
+	state.Get(thermostatSwitchedKey, &a.switched)
+}
+
+// Close stops controlling the heater.
+func (a *Thermostat) Close() {
+	close(a.stop)
+}
+
+func (a *Thermostat) run() {
+	ticker := time.NewTicker(thermostatCheckPeriod)
+	defer ticker.Stop()
+
+	a.evaluate()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+			a.evaluate()
+		}
+	}
+}
+
+// heating shows whether the heater is on.
+func (a *Thermostat) heating(on bool) {
+	state := characteristic.CurrentHeatingCoolingStateOff
+	if on {
+		state = characteristic.CurrentHeatingCoolingStateHeat
+	}
+	a.CurrentHeatingCoolingState.SetValue(state)
+}
+
+// evaluate switches the heater when the temperature left the hysteresis
+// band around the target, unless it was switched less than the minimum on
+// or off time ago. Losing the sensor switches the heater off immediately.
+// It does not heat before the first measurement, nor while turned off.
+func (a *Thermostat) evaluate() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	select {
+	case <-a.stop:
+		return
+	default:
+	}
+
+	on := a.heater.PowerOn().Value()
+	want := on
+	immediate := false
+	temperature := a.CurrentTemperature.Value()
+	target := a.TargetTemperature.Value()
+
+	switch {
+	case a.TargetHeatingCoolingState.Value() == characteristic.TargetHeatingCoolingStateOff:
+		// The heater may be switched by hand
+		return
+	case !a.sensor.Online():
+		want, immediate = false, true
+	case !a.measured:
+		want = false
+	case temperature < target-a.settings.Hysteresis:
+		want = true
+	case temperature > target+a.settings.Hysteresis:
+		want = false
+	}
+
+	if want == on || !a.heater.Online() {
+		return
+	}
+
+	minTime := a.settings.MinOffTime
+	if on {
+		minTime = a.settings.MinOnTime
+	}
+	if !immediate && time.Since(a.switched) < minTime {
+		return
+	}
+
+	log.Info("Thermostat switching heater", "device", a.config.Name, "on", want, "temperature", temperature, "target", target)
+	a.switchHeater(want)
+}
+
+// switchOff switches the heater off when the thermostat is turned off.
+func (a *Thermostat) switchOff() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.heater.PowerOn().Value() || !a.heater.Online() {
+		return
+	}
+	log.Info("Thermostat switching heater", "device", a.config.Name, "on", false)
+	a.switchHeater(false)
+}
+
+// switchHeater switches the heater and records when, for the minimum on and off times.
+func (a *Thermostat) switchHeater(on bool) {
+	a.switched = time.Now()
+	if a.state != nil {
+		a.state.Set(thermostatSwitchedKey, a.switched)
+	}
+	a.heater.SwitchPower(on)
+}
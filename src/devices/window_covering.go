@@ -0,0 +1,442 @@
+package devices
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"senhaerens.be/hap-mqtt/config"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/charmbracelet/log"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+func init() {
+	Register(Driver{
+		Key:         "window_coverings",
+		Description: "Window covering or roller shutter of a Tasmota, Shelly or FHEM device",
+		Confirm:     true,
+		Settings: func() interface{} {
+			return &config.WindowCoveringSettings{}
+		},
+		New: func(id int, config config.Device) (Device, error) {
+			return NewWindowCovering(id, config)
+		},
+	})
+}
+
+// Motor directions reported by a window covering
+const (
+	coverClosing = -1
+	coverStopped = 0
+	coverOpening = 1
+)
+
+// coverPositionStates maps the motor directions to the position state.
+var coverPositionStates = map[int]int{
+	coverClosing: characteristic.PositionStateDecreasing,
+	coverStopped: characteristic.PositionStateStopped,
+	coverOpening: characteristic.PositionStateIncreasing,
+}
+
+// windowCovering is a HomeKit window covering with an optional tilt. While
+// the motor is stopped, the target is where the covering stopped.
+type windowCovering struct {
+	*service.WindowCovering
+	CurrentTilt *characteristic.CurrentHorizontalTiltAngle // Nil without tilt
+	TargetTilt  *characteristic.TargetHorizontalTiltAngle
+}
+
+func newWindowCovering(tilt bool) *windowCovering {
+	w := &windowCovering{WindowCovering: service.NewWindowCovering()}
+	w.PositionState.SetValue(characteristic.PositionStateStopped)
+
+	if tilt {
+		w.CurrentTilt = characteristic.NewCurrentHorizontalTiltAngle()
+		w.AddC(w.CurrentTilt.C)
+		w.TargetTilt = characteristic.NewTargetHorizontalTiltAngle()
+		w.AddC(w.TargetTilt.C)
+	}
+
+	return w
+}
+
+func (w *windowCovering) stopped() bool {
+	return w.PositionState.Value() == characteristic.PositionStateStopped
+}
+
+// reportPosition sets the current position, in % open.
+func (w *windowCovering) reportPosition(r *Reachability, pos int) {
+	r.report(w.CurrentPosition.C, pos)
+	if w.stopped() {
+		r.report(w.TargetPosition.C, w.CurrentPosition.Value())
+	}
+}
+
+// reportTarget sets the position the motor is moving to.
+func (w *windowCovering) reportTarget(r *Reachability, pos int) {
+	if !w.stopped() {
+		r.report(w.TargetPosition.C, pos)
+	}
+}
+
+// reportDirection sets the motor direction.
+func (w *windowCovering) reportDirection(r *Reachability, direction int) {
+	state, ok := coverPositionStates[direction]
+	if !ok {
+		return
+	}
+	w.PositionState.SetValue(state)
+	if w.stopped() {
+		r.report(w.TargetPosition.C, w.CurrentPosition.Value())
+		if w.CurrentTilt != nil {
+			r.report(w.TargetTilt.C, w.CurrentTilt.Value())
+		}
+	}
+}
+
+// reportTilt sets the current tilt angle, in degrees.
+func (w *windowCovering) reportTilt(r *Reachability, angle int) {
+	if w.CurrentTilt == nil {
+		return
+	}
+	angle = max(-90, min(90, angle))
+	r.report(w.CurrentTilt.C, angle)
+	if w.stopped() {
+		r.report(w.TargetTilt.C, angle)
+	}
+}
+
+// shellyCoverDirection returns the motor direction of a Shelly cover state,
+// e.g. opening or stopped.
+func shellyCoverDirection(state string) int {
+	switch state {
+	case "opening":
+		return coverOpening
+	case "closing":
+		return coverClosing
+	default:
+		return coverStopped
+	}
+}
+
+// Tilt positions (0-100%), e.g. of Shelly slats, and tilt angles (-90-90°)
+func tiltAngle(pos int) int {
+	return int(math.Round(float64(pos)*1.8)) - 90
+}
+
+func tiltPercent(angle int) int {
+	return int(math.Round(float64(angle+90) / 1.8))
+}
+
+// TasmotaShutter is the state of a shutter in a RESULT or SENSOR payload.
+type TasmotaShutter struct {
+	Position  *int `json:"Position"`
+	Direction *int `json:"Direction"` // 1 opening, -1 closing, 0 stopped
+	Target    *int `json:"Target"`
+	Tilt      *int `json:"Tilt"`
+}
+
+type WindowCovering struct {
+	*accessory.A
+	*windowCovering
+	*Reachability
+	settings config.WindowCoveringSettings
+	config   config.Device
+}
+
+func NewWindowCovering(id int, cfg config.Device) (*WindowCovering, error) {
+	var settings config.WindowCoveringSettings
+	if err := cfg.Decode(&settings); err != nil {
+		return nil, err
+	}
+	switch settings.Protocol {
+	case "tasmota":
+		if settings.ID == 0 {
+			settings.ID = 1
+		}
+	case "shelly":
+		if settings.Tilt || settings.Invert {
+			return nil, fmt.Errorf("tilt and invert are not supported by protocol shelly, use a cover component of shelly_rpc for tilt")
+		}
+	case "fhem":
+	default:
+		return nil, fmt.Errorf("unknown protocol %q, expected tasmota, shelly or fhem", settings.Protocol)
+	}
+	if settings.ID < 0 {
+		return nil, fmt.Errorf("invalid id %d", settings.ID)
+	}
+
+	name := cfg.Name
+	model := "Window Covering"
+	if cfg.FriendlyName != "" {
+		name = cfg.FriendlyName
+		model = fmt.Sprintf("%s (%s)", model, cfg.Name)
+	}
+
+	manufacturer := map[string]string{"tasmota": "Tasmota", "shelly": "Shelly", "fhem": "FHEM"}[settings.Protocol]
+
+	a := WindowCovering{}
+	a.A = accessory.New(accessory.Info{
+		Name:         name,
+		Model:        model,
+		Manufacturer: manufacturer,
+	}, accessory.TypeWindowCovering)
+	a.Id = uint64(id)
+	log.Infof("HAP Create Accessory %4d - %s", a.Id, cfg.Name)
+
+	a.windowCovering = newWindowCovering(settings.Tilt)
+	a.AddS(a.windowCovering.S)
+
+	a.Reachability = newReachability(a.A, cfg)
+	a.settings = settings
+	a.config = cfg
+
+	return &a, nil
+}
+
+func (a *WindowCovering) Accessory() *accessory.A {
+	return a.A
+}
+
+// position converts between the HomeKit position (% open) and the device
+// position, which are each other's inverse with invert.
+func (a *WindowCovering) position(pos int) int {
+	if a.settings.Invert {
+		return 100 - pos
+	}
+	return pos
+}
+
+// direction converts a motor direction in the sense of the device position.
+func (a *WindowCovering) direction(direction int) int {
+	if a.settings.Invert {
+		return -direction
+	}
+	return direction
+}
+
+func (a *WindowCovering) Listen(client mqtt.Client) {
+	switch a.settings.Protocol {
+	case "tasmota":
+		a.listenTasmota(client)
+	case "shelly":
+		a.listenShelly(client)
+	case "fhem":
+		a.listenFhem(client)
+	}
+}
+
+func (a *WindowCovering) listenTasmota(client mqtt.Client) {
+	// MQTT -> HAP
+	subLwt := fmt.Sprintf("tele/%s/LWT", a.config.Name)
+	client.Subscribe(subLwt, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		msg.Ack()
+		payload := string(msg.Payload())
+		log.Debugf("MQTT received %s from %s", payload, msg.Topic())
+
+		a.SetOnline(strings.ToLower(payload) != "offline")
+	})
+
+	// Both carry the shutter state, e.g. {"Shutter1":{"Position":50,"Direction":0,"Target":50,"Tilt":0}}
+	shutter := fmt.Sprintf("Shutter%d", a.settings.ID)
+	subResult := fmt.Sprintf("stat/%s/RESULT", a.config.Name)
+	subSensor := fmt.Sprintf("tele/%s/SENSOR", a.config.Name)
+	client.SubscribeMultiple(map[string]byte{subResult: 1, subSensor: 1}, func(_ mqtt.Client, msg mqtt.Message) {
+		msg.Ack()
+		log.Debugf("MQTT received %s from %s", msg.Payload(), msg.Topic())
+
+		var state map[string]json.RawMessage
+		if err := json.Unmarshal(msg.Payload(), &state); err != nil {
+			log.Error("Failed to decode JSON payload", "err", err)
+			return
+		}
+		raw, ok := state[shutter]
+		if !ok {
+			// Results of other commands
+			return
+		}
+		var s TasmotaShutter
+		if err := json.Unmarshal(raw, &s); err != nil {
+			log.Error("Failed to decode JSON payload", "err", err)
+			return
+		}
+
+		if s.Direction != nil {
+			a.reportDirection(a.Reachability, a.direction(*s.Direction))
+		}
+		if s.Position != nil {
+			a.reportPosition(a.Reachability, a.position(*s.Position))
+		}
+		if s.Target != nil {
+			a.reportTarget(a.Reachability, a.position(*s.Target))
+		}
+		if s.Tilt != nil {
+			a.reportTilt(a.Reachability, *s.Tilt)
+		}
+	})
+
+	// HAP -> MQTT
+	pubPosition := fmt.Sprintf("cmnd/%s/ShutterPosition%d", a.config.Name, a.settings.ID)
+	onCommand(a.Reachability, a.TargetPosition.C, func(pos int) {
+		a.command(client, a.TargetPosition.C, pos, pubPosition, strconv.Itoa(a.position(pos)))
+	})
+
+	if a.TargetTilt != nil {
+		pubTilt := fmt.Sprintf("cmnd/%s/ShutterTilt%d", a.config.Name, a.settings.ID)
+		onCommand(a.Reachability, a.TargetTilt.C, func(angle int) {
+			a.command(client, a.TargetTilt.C, angle, pubTilt, strconv.Itoa(angle))
+		})
+	}
+}
+
+func (a *WindowCovering) listenShelly(client mqtt.Client) {
+	// MQTT -> HAP
+	subLwt := fmt.Sprintf("shellies/%s/online", a.config.Name)
+	client.Subscribe(subLwt, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		msg.Ack()
+		payload := string(msg.Payload())
+		log.Debugf("MQTT received %s from %s", payload, msg.Topic())
+
+		a.SetOnline(strings.ToLower(payload) != "false")
+	})
+
+	subStatus := fmt.Sprintf("shellies/%s/status/cover:%d", a.config.Name, a.settings.ID)
+	client.Subscribe(subStatus, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		msg.Ack()
+		log.Debugf("MQTT received %s from %s", msg.Payload(), msg.Topic())
+
+		var status SrpcStatus
+		if err := json.Unmarshal(msg.Payload(), &status); err != nil {
+			log.Error("Failed to decode JSON payload", "err", err)
+			return
+		}
+		a.reportShelly(a.Reachability, status)
+	})
+
+	// HAP -> MQTT
+	pubCover := fmt.Sprintf("shellies/%s/command/cover:%d", a.config.Name, a.settings.ID)
+	onCommand(a.Reachability, a.TargetPosition.C, func(pos int) {
+		payload := fmt.Sprintf("pos,%d", a.position(pos))
+		a.command(client, a.TargetPosition.C, pos, pubCover, payload)
+	})
+}
+
+// reportShelly updates the covering from the status of a Shelly cover.
+func (w *windowCovering) reportShelly(r *Reachability, status SrpcStatus) {
+	if state, ok := status.State.(string); ok {
+		w.reportDirection(r, shellyCoverDirection(state))
+	}
+	if status.CurrentPos != nil {
+		w.reportPosition(r, *status.CurrentPos)
+	}
+	if status.TargetPos != nil {
+		w.reportTarget(r, *status.TargetPos)
+	}
+	if status.SlatPos != nil {
+		w.reportTilt(r, tiltAngle(*status.SlatPos))
+	}
+}
+
+func (a *WindowCovering) listenFhem(client mqtt.Client) {
+	// MQTT -> HAP
+	subLwt := "fhem"
+	client.Subscribe(subLwt, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		msg.Ack()
+		payload := string(msg.Payload())
+		log.Debugf("MQTT received %s from %s", payload, msg.Topic())
+
+		a.SetOnline(strings.ToLower(payload) != "offline")
+	})
+
+	subPosition := fmt.Sprintf("fhem/stat/%s/position", a.config.Name)
+	client.Subscribe(subPosition, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		msg.Ack()
+		payload := string(msg.Payload())
+		log.Debugf("MQTT received %s from %s", payload, msg.Topic())
+
+		pos, err := strconv.Atoi(payload)
+		if err != nil {
+			log.Error("Failed to parse position", "device", a.config.Name, "payload", payload)
+			return
+		}
+		a.reportPosition(a.Reachability, a.position(pos))
+	})
+
+	// The motor reports up or down when it starts, and e.g. stop or open when it stops
+	subState := fmt.Sprintf("fhem/stat/%s/state", a.config.Name)
+	client.Subscribe(subState, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		msg.Ack()
+		payload := string(msg.Payload())
+		log.Debugf("MQTT received %s from %s", payload, msg.Topic())
+
+		direction := coverStopped
+		switch strings.ToLower(payload) {
+		case "up":
+			direction = coverOpening
+		case "down":
+			direction = coverClosing
+		}
+		a.reportDirection(a.Reachability, direction)
+	})
+
+	if a.CurrentTilt != nil {
+		subAngle := fmt.Sprintf("fhem/stat/%s/anglePos", a.config.Name)
+		client.Subscribe(subAngle, 1, func(_ mqtt.Client, msg mqtt.Message) {
+			msg.Ack()
+			payload := string(msg.Payload())
+			log.Debugf("MQTT received %s from %s", payload, msg.Topic())
+
+			angle, err := strconv.Atoi(payload)
+			if err != nil {
+				log.Error("Failed to parse angle", "device", a.config.Name, "payload", payload)
+				return
+			}
+			a.reportTilt(a.Reachability, angle)
+		})
+	}
+
+	// HAP -> MQTT
+	// FHEM sets the position and the angle with a single command: <position> [<angle>]
+	pubPosition := fmt.Sprintf("fhem/cmnd/%s/position", a.config.Name)
+	payload := func(pos, angle int) string {
+		if a.TargetTilt != nil {
+			return fmt.Sprintf("%d %d", a.position(pos), angle)
+		}
+		return strconv.Itoa(a.position(pos))
+	}
+	onCommand(a.Reachability, a.TargetPosition.C, func(pos int) {
+		angle := 0
+		if a.TargetTilt != nil {
+			angle = a.TargetTilt.Value()
+		}
+		a.command(client, a.TargetPosition.C, pos, pubPosition, payload(pos, angle))
+	})
+
+	if a.TargetTilt != nil {
+		onCommand(a.Reachability, a.TargetTilt.C, func(angle int) {
+			a.command(client, a.TargetTilt.C, angle, pubPosition, payload(a.TargetPosition.Value(), angle))
+		})
+	}
+}
+
+// RequestState asks the device to publish the state of the covering.
+func (a *WindowCovering) RequestState(client mqtt.Client) {
+	switch a.settings.Protocol {
+	case "tasmota":
+		// An empty ShutterPosition is answered with the shutter state on the RESULT topic
+		pubPosition := fmt.Sprintf("cmnd/%s/ShutterPosition%d", a.config.Name, a.settings.ID)
+		a.publish(client, pubPosition, "")
+	case "shelly":
+		pubCommand := fmt.Sprintf("shellies/%s/command", a.config.Name)
+		a.publish(client, pubCommand, "status_update")
+	case "fhem":
+		pubRequest := fmt.Sprintf("fhem/cmnd/%s/statusRequest", a.config.Name)
+		a.publish(client, pubRequest, "")
+	}
+}
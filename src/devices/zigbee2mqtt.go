@@ -0,0 +1,577 @@
+package devices
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"senhaerens.be/hap-mqtt/config"
+	eveservice "senhaerens.be/hap-mqtt/service"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/charmbracelet/log"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+func init() {
+	Register(Driver{
+		Key:         "zigbee2mqtt",
+		Description: "Zigbee2MQTT device, configured from the devices Zigbee2MQTT publishes",
+		Confirm:     true,
+		Settings: func() interface{} {
+			return &config.Zigbee2MQTTSettings{}
+		},
+		New: func(id int, config config.Device) (Device, error) {
+			return NewZigbee2MQTTDevice(id, config)
+		},
+	})
+}
+
+// Access bits of an exposed property
+const (
+	z2mPublished = 1 << iota
+	z2mSettable
+	z2mGettable
+)
+
+// z2mBinding binds a characteristic to a property of the device state.
+type z2mBinding struct {
+	c        *characteristic.C
+	property string
+	access   int
+	decode   func(v interface{}) (interface{}, bool)
+	encode   func(v interface{}) interface{} // Nil when not settable
+}
+
+// z2mService is a HomeKit service created from an exposes definition.
+type z2mService struct {
+	service  *service.S
+	category byte
+	bindings []*z2mBinding
+
+	// Update and listen of services which are not bound property by property
+	update func(a *Zigbee2MQTTDevice, state map[string]interface{})
+	listen func(a *Zigbee2MQTTDevice, client mqtt.Client)
+}
+
+// bind adds a binding of c to the property of e.
+func (s *z2mService) bind(c *characteristic.C, e *config.Zigbee2MQTTExpose, decode func(interface{}) (interface{}, bool), encode func(interface{}) interface{}) {
+	if e.Access&z2mSettable == 0 {
+		encode = nil
+	}
+	s.bindings = append(s.bindings, &z2mBinding{c: c, property: e.Property, access: e.Access, decode: decode, encode: encode})
+}
+
+// z2mFeatures returns the features of e by name, e.g. state and brightness.
+func z2mFeatures(e config.Zigbee2MQTTExpose) map[string]*config.Zigbee2MQTTExpose {
+	features := map[string]*config.Zigbee2MQTTExpose{}
+	for i := range e.Features {
+		features[e.Features[i].Name] = &e.Features[i]
+	}
+	return features
+}
+
+// z2mOnOff decodes and encodes the values of a binary property.
+func z2mOnOff(e *config.Zigbee2MQTTExpose) (func(interface{}) (interface{}, bool), func(interface{}) interface{}) {
+	on, off := e.ValueOn, e.ValueOff
+	if on == nil {
+		on, off = "ON", "OFF"
+	}
+	decode := func(v interface{}) (interface{}, bool) {
+		switch fmt.Sprint(v) {
+		case fmt.Sprint(on):
+			return true, true
+		case fmt.Sprint(off):
+			return false, true
+		}
+		return nil, false
+	}
+	encode := func(v interface{}) interface{} {
+		if v == true {
+			return on
+		}
+		return off
+	}
+	return decode, encode
+}
+
+// z2mNumber decodes numeric properties.
+func z2mNumber(v interface{}) (interface{}, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+// z2mScale decodes and encodes a numeric property ranging up to the maximum
+// of e, e.g. a brightness up to 254, as a value ranging up to max.
+func z2mScale(e *config.Zigbee2MQTTExpose, max float64) (func(interface{}) (interface{}, bool), func(interface{}) interface{}) {
+	valueMax := max
+	if e.ValueMax != nil && *e.ValueMax > 0 {
+		valueMax = *e.ValueMax
+	}
+	decode := func(v interface{}) (interface{}, bool) {
+		f, ok := v.(float64)
+		return int(math.Round(f / valueMax * max)), ok
+	}
+	encode := func(v interface{}) interface{} {
+		return int(math.Round(float64(v.(int)) * valueMax / max))
+	}
+	return decode, encode
+}
+
+// z2mDetected decodes a binary sensor property to the detected and not
+// detected values of a characteristic.
+func z2mDetected(detected, notDetected int) func(interface{}) (interface{}, bool) {
+	return func(v interface{}) (interface{}, bool) {
+		b, ok := v.(bool)
+		if b {
+			return detected, ok
+		}
+		return notDetected, ok
+	}
+}
+
+// newZ2MServices creates the services of the supported exposes, nil when
+// none is supported.
+func newZ2MServices(exposes []config.Zigbee2MQTTExpose) []*z2mService {
+	var services []*z2mService
+	var battery *service.BatteryService
+	batteryService := func() *z2mService {
+		if battery == nil {
+			battery = service.NewBatteryService()
+			battery.ChargingState.SetValue(characteristic.ChargingStateNotChargeable)
+			services = append(services, &z2mService{service: battery.S, category: accessory.TypeSensor})
+		}
+		for _, s := range services {
+			if s.service == battery.S {
+				return s
+			}
+		}
+		return nil
+	}
+
+	for i := range exposes {
+		e := &exposes[i]
+		var s *z2mService
+		switch e.Type {
+		case "light":
+			s = newZ2MLight(*e)
+		case "switch":
+			s = newZ2MSwitch(*e)
+		case "cover":
+			s = newZ2MCover(*e)
+		case "binary", "numeric":
+			if e.Access&z2mPublished == 0 {
+				continue
+			}
+			switch e.Name {
+			case "battery":
+				batteryService().bind(battery.BatteryLevel.C, e, z2mNumber, nil)
+				continue
+			case "battery_low":
+				batteryService().bind(battery.StatusLowBattery.C, e, z2mDetected(characteristic.StatusLowBatteryBatteryLevelLow, characteristic.StatusLowBatteryBatteryLevelNormal), nil)
+				continue
+			}
+			s = newZ2MSensor(e)
+		}
+		if s == nil {
+			continue
+		}
+
+		// Services of endpoints are told apart by name, e.g. l1 and l2
+		if e.Endpoint != "" {
+			name := characteristic.NewName()
+			name.SetValue(e.Endpoint)
+			s.service.AddC(name.C)
+		}
+		services = append(services, s)
+	}
+
+	// The battery is no primary service
+	if len(services) > 0 && battery != nil && services[0].service == battery.S {
+		services = append(services[1:], services[0])
+	}
+	if len(services) == 1 && battery != nil {
+		return nil
+	}
+
+	return services
+}
+
+func newZ2MLight(e config.Zigbee2MQTTExpose) *z2mService {
+	features := z2mFeatures(e)
+	state := features["state"]
+	if state == nil {
+		return nil
+	}
+
+	light := service.NewLightbulb()
+	s := &z2mService{service: light.S, category: accessory.TypeLightbulb}
+	decode, encode := z2mOnOff(state)
+	s.bind(light.On.C, state, decode, encode)
+
+	if f := features["brightness"]; f != nil {
+		brightness := characteristic.NewBrightness()
+		light.AddC(brightness.C)
+		decode, encode := z2mScale(f, 100)
+		s.bind(brightness.C, f, decode, encode)
+	}
+
+	if f := features["color_temp"]; f != nil {
+		temp := characteristic.NewColorTemperature()
+		if f.ValueMin != nil && f.ValueMax != nil {
+			temp.SetMinValue(int(*f.ValueMin))
+			temp.SetMaxValue(int(*f.ValueMax))
+		}
+		light.AddC(temp.C)
+		s.bind(temp.C, f, z2mNumber, func(v interface{}) interface{} { return v })
+	}
+
+	f := features["color_hs"]
+	if f == nil {
+		f = features["color_xy"]
+	}
+	if f != nil {
+		hue := characteristic.NewHue()
+		light.AddC(hue.C)
+		saturation := characteristic.NewSaturation()
+		light.AddC(saturation.C)
+
+		// Zigbee2MQTT converts hue and saturation for xy lights, but may
+		// only report x and y
+		color := func(v interface{}) (float64, float64, bool) {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return 0, 0, false
+			}
+			h, okH := m["hue"].(float64)
+			sat, okS := m["saturation"].(float64)
+			if okH && okS {
+				return h, sat, true
+			}
+			x, okX := m["x"].(float64)
+			y, okY := m["y"].(float64)
+			if okX && okY {
+				h, sat = xyToHueSaturation(x, y)
+				return h, sat, true
+			}
+			return 0, 0, false
+		}
+		// Commands run before the written value is set
+		s.bind(hue.C, f, func(v interface{}) (interface{}, bool) {
+			h, _, ok := color(v)
+			return h, ok
+		}, func(v interface{}) interface{} {
+			return map[string]interface{}{"hue": v, "saturation": saturation.Value()}
+		})
+		s.bind(saturation.C, f, func(v interface{}) (interface{}, bool) {
+			_, sat, ok := color(v)
+			return sat, ok
+		}, func(v interface{}) interface{} {
+			return map[string]interface{}{"hue": hue.Value(), "saturation": v}
+		})
+	}
+
+	return s
+}
+
+func newZ2MSwitch(e config.Zigbee2MQTTExpose) *z2mService {
+	state := z2mFeatures(e)["state"]
+	if state == nil {
+		return nil
+	}
+
+	sw := service.NewSwitch()
+	s := &z2mService{service: sw.S, category: accessory.TypeSwitch}
+	decode, encode := z2mOnOff(state)
+	s.bind(sw.On.C, state, decode, encode)
+
+	return s
+}
+
+func newZ2MCover(e config.Zigbee2MQTTExpose) *z2mService {
+	features := z2mFeatures(e)
+	position := features["position"]
+	if position == nil {
+		return nil
+	}
+	tilt := features["tilt"]
+
+	cover := newWindowCovering(tilt != nil)
+	s := &z2mService{service: cover.S, category: accessory.TypeWindowCovering}
+
+	s.update = func(a *Zigbee2MQTTDevice, state map[string]interface{}) {
+		// Reported by some covers while the motor runs
+		switch state["moving"] {
+		case "UP":
+			cover.reportDirection(a.Reachability, coverOpening)
+		case "DOWN":
+			cover.reportDirection(a.Reachability, coverClosing)
+		case "STOP":
+			cover.reportDirection(a.Reachability, coverStopped)
+		}
+		if pos, ok := state[position.Property].(float64); ok {
+			cover.reportPosition(a.Reachability, int(pos))
+		}
+		if tilt != nil {
+			if pos, ok := state[tilt.Property].(float64); ok {
+				cover.reportTilt(a.Reachability, tiltAngle(int(pos)))
+			}
+		}
+	}
+
+	s.listen = func(a *Zigbee2MQTTDevice, client mqtt.Client) {
+		onCommand(a.Reachability, cover.TargetPosition.C, func(pos int) {
+			a.set(client, cover.TargetPosition.C, pos, map[string]interface{}{position.Property: pos})
+		})
+		if tilt != nil {
+			onCommand(a.Reachability, cover.TargetTilt.C, func(angle int) {
+				a.set(client, cover.TargetTilt.C, angle, map[string]interface{}{tilt.Property: tiltPercent(angle)})
+			})
+		}
+	}
+
+	return s
+}
+
+func newZ2MSensor(e *config.Zigbee2MQTTExpose) *z2mService {
+	s := &z2mService{category: accessory.TypeSensor}
+
+	switch {
+	case e.Name == "contact":
+		// Contact is true while closed
+		sensor := service.NewContactSensor()
+		s.service = sensor.S
+		s.bind(sensor.ContactSensorState.C, e, z2mDetected(characteristic.ContactSensorStateContactDetected, characteristic.ContactSensorStateContactNotDetected), nil)
+	case e.Name == "occupancy":
+		sensor := service.NewOccupancySensor()
+		s.service = sensor.S
+		s.bind(sensor.OccupancyDetected.C, e, z2mDetected(characteristic.OccupancyDetectedOccupancyDetected, characteristic.OccupancyDetectedOccupancyNotDetected), nil)
+	case e.Name == "water_leak":
+		sensor := service.NewLeakSensor()
+		s.service = sensor.S
+		s.bind(sensor.LeakDetected.C, e, z2mDetected(characteristic.LeakDetectedLeakDetected, characteristic.LeakDetectedLeakNotDetected), nil)
+	case e.Name == "smoke":
+		sensor := service.NewSmokeSensor()
+		s.service = sensor.S
+		s.bind(sensor.SmokeDetected.C, e, z2mDetected(characteristic.SmokeDetectedSmokeDetected, characteristic.SmokeDetectedSmokeNotDetected), nil)
+	case e.Name == "temperature":
+		sensor := service.NewTemperatureSensor()
+		sensor.CurrentTemperature.SetMinValue(-50)
+		s.service = sensor.S
+		s.bind(sensor.CurrentTemperature.C, e, z2mNumber, nil)
+	case e.Name == "humidity":
+		sensor := service.NewHumiditySensor()
+		s.service = sensor.S
+		s.bind(sensor.CurrentRelativeHumidity.C, e, z2mNumber, nil)
+	case e.Name == "pressure":
+		sensor := eveservice.NewEveAirPressureSensor()
+		s.service = sensor.S
+		s.bind(sensor.AirPressure.C, e, z2mNumber, nil)
+	case e.Name == "illuminance_lux", e.Name == "illuminance" && e.Unit == "lx":
+		sensor := service.NewLightSensor()
+		s.service = sensor.S
+		s.bind(sensor.CurrentAmbientLightLevel.C, e, z2mNumber, nil)
+	default:
+		return nil
+	}
+
+	return s
+}
+
+// xyToHueSaturation converts a CIE xy color to hue (°) and saturation (%).
+func xyToHueSaturation(x, y float64) (float64, float64) {
+	if y <= 0 {
+		return 0, 0
+	}
+
+	// XYZ with Y = 1 to linear sRGB
+	X, Z := x/y, (1-x-y)/y
+	r := math.Max(0, 3.2406*X-1.5372-0.4986*Z)
+	g := math.Max(0, -0.9689*X+1.8758+0.0415*Z)
+	b := math.Max(0, 0.0557*X-0.2040+1.0570*Z)
+
+	hi := math.Max(r, math.Max(g, b))
+	lo := math.Min(r, math.Min(g, b))
+	if hi == 0 || hi == lo {
+		return 0, 0
+	}
+
+	var hue float64
+	switch d := hi - lo; hi {
+	case r:
+		hue = math.Mod((g-b)/d, 6)
+	case g:
+		hue = (b-r)/d + 2
+	default:
+		hue = (r-g)/d + 4
+	}
+	hue *= 60
+	if hue < 0 {
+		hue += 360
+	}
+
+	return math.Round(hue), math.Round((hi - lo) / hi * 100)
+}
+
+type Zigbee2MQTTDevice struct {
+	*accessory.A
+	Services []*z2mService
+	*Reachability
+	settings config.Zigbee2MQTTSettings
+	config   config.Device
+}
+
+func NewZigbee2MQTTDevice(id int, cfg config.Device) (*Zigbee2MQTTDevice, error) {
+	var settings config.Zigbee2MQTTSettings
+	if err := cfg.Decode(&settings); err != nil {
+		return nil, err
+	}
+	if settings.BaseTopic == "" {
+		settings.BaseTopic = defaultZigbee2MQTTBaseTopic
+	}
+	if settings.Device == "" {
+		settings.Device = cfg.Name
+	}
+
+	services := newZ2MServices(settings.Exposes)
+	if len(services) == 0 {
+		return nil, errors.New("no supported exposes")
+	}
+
+	name := settings.Device
+	model := settings.Model
+	if cfg.FriendlyName != "" {
+		name = cfg.FriendlyName
+		model = fmt.Sprintf("%s (%s)", model, settings.Device)
+	}
+
+	a := Zigbee2MQTTDevice{}
+	a.A = accessory.New(accessory.Info{
+		Name:         name,
+		SerialNumber: settings.IEEEAddress,
+		Model:        model,
+		Manufacturer: settings.Vendor,
+	}, services[0].category)
+	a.Id = uint64(id)
+	log.Infof("HAP Create Accessory %4d - %s", a.Id, settings.Device)
+
+	// The first service is the primary service, linked to the others
+	for i, s := range services {
+		a.AddS(s.service)
+		if i == 0 {
+			s.service.Primary = true
+			continue
+		}
+		services[0].service.AddS(s.service)
+	}
+	a.Services = services
+
+	a.Reachability = newReachability(a.A, cfg)
+	a.settings = settings
+	a.config = cfg
+
+	return &a, nil
+}
+
+func (a *Zigbee2MQTTDevice) Accessory() *accessory.A {
+	return a.A
+}
+
+func (a *Zigbee2MQTTDevice) topic() string {
+	return fmt.Sprintf("%s/%s", a.settings.BaseTopic, a.settings.Device)
+}
+
+func (a *Zigbee2MQTTDevice) Listen(client mqtt.Client) {
+	// MQTT -> HAP
+	// Published when availability is enabled in Zigbee2MQTT, as JSON or legacy string
+	subAvailability := fmt.Sprintf("%s/availability", a.topic())
+	client.Subscribe(subAvailability, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		msg.Ack()
+		payload := string(msg.Payload())
+		log.Debugf("MQTT received %s from %s", payload, msg.Topic())
+
+		var availability struct {
+			State string `json:"state"`
+		}
+		if json.Unmarshal(msg.Payload(), &availability) == nil {
+			payload = availability.State
+		}
+		a.SetOnline(strings.ToLower(payload) != "offline")
+	})
+
+	subState := a.topic()
+	client.Subscribe(subState, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		msg.Ack()
+		log.Debugf("MQTT received %s from %s", msg.Payload(), msg.Topic())
+
+		var state map[string]interface{}
+		if err := json.Unmarshal(msg.Payload(), &state); err != nil {
+			log.Error("Failed to decode JSON payload", "err", err)
+			return
+		}
+
+		for _, s := range a.Services {
+			for _, b := range s.bindings {
+				raw, ok := state[b.property]
+				if !ok {
+					continue
+				}
+				if v, ok := b.decode(raw); ok {
+					a.report(b.c, v)
+				}
+			}
+			if s.update != nil {
+				s.update(a, state)
+			}
+		}
+	})
+
+	// HAP -> MQTT
+	for _, s := range a.Services {
+		for _, b := range s.bindings {
+			if b.encode == nil {
+				continue
+			}
+			onCommand(a.Reachability, b.c, func(new interface{}) {
+				a.set(client, b.c, new, map[string]interface{}{b.property: b.encode(new)})
+			})
+		}
+		if s.listen != nil {
+			s.listen(a, client)
+		}
+	}
+}
+
+// set publishes a command setting c to want.
+func (a *Zigbee2MQTTDevice) set(client mqtt.Client, c *characteristic.C, want interface{}, values map[string]interface{}) {
+	pubSet := fmt.Sprintf("%s/set", a.topic())
+	payload, _ := json.Marshal(values)
+	a.command(client, c, want, pubSet, string(payload))
+}
+
+// RequestState asks Zigbee2MQTT to read the gettable properties of the
+// lights and switches, which it publishes on the state topic.
+func (a *Zigbee2MQTTDevice) RequestState(client mqtt.Client) {
+	get := map[string]string{}
+	for _, s := range a.Services {
+		if s.category == accessory.TypeSensor {
+			continue
+		}
+		for _, b := range s.bindings {
+			if b.access&z2mGettable != 0 {
+				get[b.property] = ""
+			}
+		}
+	}
+	if len(get) == 0 {
+		return
+	}
+
+	pubGet := fmt.Sprintf("%s/get", a.topic())
+	payload, _ := json.Marshal(get)
+	a.publish(client, pubGet, string(payload))
+}
@@ -0,0 +1,177 @@
+package devices
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+
+	"senhaerens.be/hap-mqtt/config"
+
+	"github.com/charmbracelet/log"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	defaultZigbee2MQTTBaseTopic = "zigbee2mqtt"
+	zigbee2MQTTDevicesFile      = "zigbee2mqtt_devices.json"
+)
+
+// Z2mDevice is a device published on <base_topic>/bridge/devices.
+type Z2mDevice struct {
+	IEEEAddress        string `json:"ieee_address"`
+	Type               string `json:"type"`
+	FriendlyName       string `json:"friendly_name"`
+	Disabled           bool   `json:"disabled"`
+	Supported          bool   `json:"supported"`
+	InterviewCompleted bool   `json:"interview_completed"`
+	Definition         *struct {
+		Model   string                     `json:"model"`
+		Vendor  string                     `json:"vendor"`
+		Exposes []config.Zigbee2MQTTExpose `json:"exposes"`
+	} `json:"definition"`
+}
+
+// Zigbee2MQTT discovers the devices of a Zigbee2MQTT bridge. The last
+// published devices are kept in the HAP db dir, so the accessories exist
+// before the broker is reached.
+type Zigbee2MQTT struct {
+	baseTopic string
+	path      string
+	changed   func()
+
+	mu      sync.Mutex
+	devices []Z2mDevice // Supported devices, in the published order
+}
+
+// NewZigbee2MQTT calls changed whenever the supported devices change.
+func NewZigbee2MQTT(baseTopic string, dir string, changed func()) *Zigbee2MQTT {
+	if baseTopic == "" {
+		baseTopic = defaultZigbee2MQTTBaseTopic
+	}
+	z := &Zigbee2MQTT{
+		baseTopic: baseTopic,
+		path:      filepath.Join(dir, zigbee2MQTTDevicesFile),
+		changed:   changed,
+	}
+
+	b, err := os.ReadFile(z.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Error("Failed reading Zigbee2MQTT devices", "error", err)
+	}
+	if err == nil {
+		if z.devices, err = z.decode(b); err != nil {
+			log.Error("Failed decoding Zigbee2MQTT devices", "path", z.path, "error", err)
+		}
+	}
+
+	return z
+}
+
+// decode returns the devices which have supported exposes.
+func (z *Zigbee2MQTT) decode(payload []byte) ([]Z2mDevice, error) {
+	var all []Z2mDevice
+	if err := json.Unmarshal(payload, &all); err != nil {
+		return nil, err
+	}
+
+	var devices []Z2mDevice
+	for _, d := range all {
+		if d.Type == "Coordinator" || d.Disabled || !d.Supported || !d.InterviewCompleted || d.Definition == nil {
+			continue
+		}
+		if len(newZ2MServices(d.Definition.Exposes)) == 0 {
+			log.Debug("Zigbee2MQTT device has no supported exposes", "device", d.FriendlyName)
+			continue
+		}
+		devices = append(devices, d)
+	}
+
+	return devices, nil
+}
+
+func (z *Zigbee2MQTT) Listen(client mqtt.Client) {
+	// MQTT -> HAP
+	subDevices := fmt.Sprintf("%s/bridge/devices", z.baseTopic)
+	client.Subscribe(subDevices, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		msg.Ack()
+		log.Debugf("MQTT received %d bytes from %s", len(msg.Payload()), msg.Topic())
+
+		devices, err := z.decode(msg.Payload())
+		if err != nil {
+			log.Error("Failed to decode JSON payload", "err", err)
+			return
+		}
+
+		z.mu.Lock()
+		unchanged := reflect.DeepEqual(z.devices, devices)
+		z.devices = devices
+		z.mu.Unlock()
+		if unchanged {
+			return
+		}
+
+		log.Infof("MQTT Zigbee2MQTT published %d supported devices", len(devices))
+		if err := os.WriteFile(z.path, msg.Payload(), 0600); err != nil {
+			log.Error("Failed saving Zigbee2MQTT devices", "error", err)
+		}
+		z.changed()
+	})
+}
+
+// Devices returns the configurations of the discovered devices selected by
+// cfg. Devices configured by hand are left out.
+//
+// The devices are named by IEEE address, which keeps their accessory IDs
+// when renamed in Zigbee2MQTT. The friendly name is used in the topics.
+func (z *Zigbee2MQTT) Devices(cfg config.Zigbee2MQTT, configured []config.Device) []config.Device {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	var configuredNames []string
+	for _, c := range configured {
+		configuredNames = append(configuredNames, c.Name)
+		var settings config.Zigbee2MQTTSettings
+		if c.Decode(&settings) == nil && settings.Device != "" {
+			configuredNames = append(configuredNames, settings.Device)
+		}
+	}
+
+	var devices []config.Device
+	for _, d := range z.devices {
+		names := []string{d.FriendlyName, d.IEEEAddress}
+		listed := func(list []string) bool {
+			return slices.ContainsFunc(names, func(name string) bool { return slices.Contains(list, name) })
+		}
+		if len(cfg.Include) > 0 && !listed(cfg.Include) {
+			continue
+		}
+		if listed(cfg.Exclude) || listed(configuredNames) {
+			continue
+		}
+
+		name := cfg.Names[d.FriendlyName]
+		if name == "" {
+			name = cfg.Names[d.IEEEAddress]
+		}
+		devices = append(devices, config.Device{
+			Name:         d.IEEEAddress,
+			FriendlyName: name,
+			Settings: map[string]interface{}{
+				"base_topic":   z.baseTopic,
+				"device":       d.FriendlyName,
+				"ieee_address": d.IEEEAddress,
+				"vendor":       d.Definition.Vendor,
+				"model":        d.Definition.Model,
+				"exposes":      d.Definition.Exposes,
+			},
+		})
+	}
+
+	return devices
+}
@@ -2,24 +2,32 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
+	"maps"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"runtime"
+	"slices"
+	"strings"
 	"syscall"
+	"time"
 
 	"senhaerens.be/hap-mqtt/config"
 	"senhaerens.be/hap-mqtt/devices"
+	"senhaerens.be/hap-mqtt/store"
 
 	"github.com/brutella/hap"
 	"github.com/brutella/hap/accessory"
 	haplog "github.com/brutella/hap/log"
 	"github.com/charmbracelet/log"
 	"github.com/eclipse/paho.mqtt.golang"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -28,38 +36,56 @@ const (
 
 var (
 	configPath  = flag.String("config", "data/config.yml", "Configuration filepath")
-	printConfig = flag.Bool("printcfg", false, "Print configuration")
+	printConfig = flag.Bool("printcfg", false, "Print configuration and registered drivers")
 	debugLog    = flag.Bool("debug", false, "Enable debug log")
 	debugHapLog = flag.Bool("debughap", false, "Enable HAP debug log")
 )
 
-func setupConfig(fpath string, print bool) config.Config {
+func loadConfig(fpath string) (config.Config, error) {
+	var cfg config.Config
+
 	f, err := os.Open(fpath)
 	if err != nil {
-		log.Fatal("Config filepath not found", "error", err)
+		return cfg, err
 	}
 	defer f.Close()
 
-	var cfg config.Config
 	decoder := yaml.NewDecoder(f)
 	err = decoder.Decode(&cfg)
-	if err != nil {
+	return cfg, err
+}
+
+func setupConfig(fpath string, print bool) config.Config {
+	cfg, err := loadConfig(fpath)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Fatal("Config filepath not found", "error", err)
+	} else if err != nil {
 		log.Fatal("Failed decoding configuration", "error", err)
 	}
 
 	if print {
-		d, err := yaml.Marshal(&cfg)
-		if err != nil {
+		var d strings.Builder
+		encoder := yaml.NewEncoder(&d)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(&cfg); err != nil {
 			log.Fatal("Failed printing configuration", "error", err)
 		}
-		fmt.Printf("# %s\n%s\n", fpath, string(d))
+		fmt.Printf("# %s\n%s\n", fpath, d.String())
+		fmt.Printf("# Registered drivers\n")
+		for _, line := range strings.Split(strings.TrimSpace(devices.Usage()), "\n") {
+			fmt.Printf("# %s\n", line)
+		}
 		os.Exit(0)
 	}
 
+	if err := devices.Validate(cfg.Devices); err != nil {
+		log.Fatal("Invalid device configuration", "error", err)
+	}
+
 	return cfg
 }
 
-func setupMqtt(cfg config.Config) *mqtt.ClientOptions {
+func setupMqtt(cfg config.Config, b *bridge) *mqtt.ClientOptions {
 	opts := mqtt.NewClientOptions()
 	if cfg.Mqtt.Broker == "" {
 		log.Fatal("MQTT broker is not specified in configuration")
@@ -79,18 +105,131 @@ func setupMqtt(cfg config.Config) *mqtt.ClientOptions {
 	log.Debug("MQTT Set", "Clientid", cfg.Mqtt.ClientID)
 	opts.SetClientID(cfg.Mqtt.ClientID)
 
-	opts.OnConnect = func(_ mqtt.Client) {
+	tlsConfig, err := setupTLS(cfg)
+	if err != nil {
+		log.Fatal("Failed setting up MQTT TLS", "error", err)
+	}
+	if tlsConfig != nil {
+		if u, err := url.Parse(cfg.Mqtt.Broker); err == nil && !slices.Contains([]string{"ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "wss"}, u.Scheme) {
+			log.Warn("MQTT TLS is configured but broker scheme is not secure", "broker", cfg.Mqtt.Broker)
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	// Announce availability of the bridge
+	topic, _, offline := mqttAvailability(cfg)
+	opts.SetWill(topic, offline, 1, true)
+
+	// Keep retrying in the background when the broker is unreachable
+	opts.SetConnectRetry(true)
+	opts.SetAutoReconnect(true)
+	if cfg.Mqtt.ConnectRetryInterval > 0 {
+		opts.SetConnectRetryInterval(cfg.Mqtt.ConnectRetryInterval)
+	}
+	if cfg.Mqtt.MaxReconnectInterval > 0 {
+		opts.SetMaxReconnectInterval(cfg.Mqtt.MaxReconnectInterval)
+	}
+
+	opts.OnConnect = func(client mqtt.Client) {
 		log.Info("MQTT connected", "broker", opts.Servers)
+		b.connected()
+		publishAvailability(client, cfg, true)
 	}
 
 	opts.OnConnectionLost = func(_ mqtt.Client, err error) {
 		log.Error("MQTT connection lost", "error", err)
+		devices.SetBrokerConnected(false)
+	}
+
+	opts.OnReconnecting = func(_ mqtt.Client, _ *mqtt.ClientOptions) {
+		log.Debug("MQTT reconnecting", "broker", opts.Servers)
 	}
 
 	return opts
 }
 
-func setupSignals() context.Context {
+// mqttAvailability returns the availability topic and payloads with defaults applied.
+func mqttAvailability(cfg config.Config) (topic, online, offline string) {
+	avail := cfg.Mqtt.Availability
+	topic, online, offline = avail.Topic, avail.PayloadOnline, avail.PayloadOffline
+
+	if topic == "" {
+		clientID := cfg.Mqtt.ClientID
+		if clientID == "" {
+			clientID = programName
+		}
+		topic = clientID + "/status"
+	}
+	if online == "" {
+		online = "online"
+	}
+	if offline == "" {
+		offline = "offline"
+	}
+
+	return topic, online, offline
+}
+
+// publishAvailability publishes the retained birth or offline message.
+func publishAvailability(client mqtt.Client, cfg config.Config, isOnline bool) {
+	topic, online, offline := mqttAvailability(cfg)
+	payload := offline
+	if isOnline {
+		payload = online
+	}
+
+	token := client.Publish(topic, 1, true, payload)
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		log.Error("MQTT failed publishing availability", "topic", topic, "error", token.Error())
+		return
+	}
+	log.Debugf("MQTT published %s to %s", payload, topic)
+}
+
+// setupTLS returns nil when no TLS settings are configured.
+func setupTLS(cfg config.Config) (*tls.Config, error) {
+	c := cfg.Mqtt.TLS
+	if c.CAFile == "" && c.CertFile == "" && c.KeyFile == "" && c.ServerName == "" && !c.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in CA file %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("client certificate requires both cert_file and key_file")
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.InsecureSkipVerify {
+		log.Warn("MQTT TLS certificate verification is disabled")
+	}
+
+	return tlsConfig, nil
+}
+
+// setupSignals calls stop before cancelling the returned context.
+func setupSignals(stop func()) context.Context {
 	chanSigs := make(chan os.Signal, 1)
 	signal.Notify(chanSigs, os.Interrupt, os.Kill, syscall.SIGTERM)
 
@@ -100,116 +239,123 @@ func setupSignals() context.Context {
 		log.Debug("Received", "signal", sig)
 		log.Info("Stopping " + programName)
 		signal.Stop(chanSigs)
+		stop()
 		cancel()
 	}()
 
 	return ctx
 }
 
-type devicer interface {
-	Listen(mqtt.Client)
-	Accessory() *accessory.A
-}
+// setupReload also returns the channel for reloads triggered by the bridge,
+// e.g. when Zigbee2MQTT published other devices.
+func setupReload() chan os.Signal {
+	chanReload := make(chan os.Signal, 1)
+	signal.Notify(chanReload, syscall.SIGHUP)
 
-type deviceOptions struct {
-	configs     []config.Device
-	offset      int
-	mqttClient  mqtt.Client
-	accessories *[]*accessory.A
+	return chanReload
 }
 
-func makeDevices[T devicer](newDevice func(int, config.Device) T, opts deviceOptions) []T {
-	devices := make([]T, len(opts.configs))
+// reloadConfig re-reads the configuration and updates the bridged devices.
+// It returns false when the configuration could not be applied.
+func reloadConfig(fpath string, b *bridge, z2m *devices.Zigbee2MQTT) bool {
+	log.Info("Reloading configuration", "config", fpath)
+	cfg, err := loadConfig(fpath)
+	if err == nil {
+		err = devices.Validate(cfg.Devices)
+	}
+	if err != nil {
+		log.Error("Failed reloading configuration", "error", err)
+		return false
+	}
 
-	for i, config := range opts.configs {
-		device := newDevice(i+opts.offset, config)
-		device.Listen(opts.mqttClient)
-		devices[i] = device
-		*opts.accessories = append(*opts.accessories, device.Accessory())
+	if err := b.update(deviceConfigs(cfg, z2m)); err != nil {
+		log.Error("Failed updating devices", "error", err)
 	}
 
-	return devices
+	return true
 }
 
-func main() {
-	flag.Parse()
-
-	// Do not output timestamp when running under systemd
-	if a, b := os.Getenv("INVOCATION_ID"), os.Getenv("JOURNAL_STREAM"); a != "" && b != "" {
-		log.SetReportTimestamp(false)
+// deviceConfigs adds the devices discovered from Zigbee2MQTT to the
+// configured devices. Changing the Zigbee2MQTT settings other than the
+// selection of devices requires a restart.
+func deviceConfigs(cfg config.Config, z2m *devices.Zigbee2MQTT) map[string][]config.Device {
+	if z2m == nil || !cfg.Zigbee2MQTT.Enabled {
+		return cfg.Devices
 	}
 
-	if *debugHapLog {
-		haplog.Debug.Enable()
+	configs := maps.Clone(cfg.Devices)
+	if configs == nil {
+		configs = map[string][]config.Device{}
 	}
+	configured := configs["zigbee2mqtt"]
+	configs["zigbee2mqtt"] = append(slices.Clone(configured), z2m.Devices(cfg.Zigbee2MQTT, configured)...)
 
-	// Setup config
-	cfg := setupConfig(*configPath, *printConfig)
-	if *debugLog {
-		log.SetLevel(log.DebugLevel)
-	}
+	return configs
+}
 
-	// Setup MQTT client
-	mqttOpts := setupMqtt(cfg)
-	mqttClient := mqtt.NewClient(mqttOpts)
-	log.Debug("Starting MQTT client")
-	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal("MQTT could not connect", "token", token.Error())
+// serveHap runs the HAP server until ctx is done or the configuration
+// was reloaded, in which case it returns true.
+func serveHap(ctx context.Context, hapServer *hap.Server, reload <-chan os.Signal, b *bridge, z2m *devices.Zigbee2MQTT) (bool, error) {
+	serverCtx, stopServer := context.WithCancel(ctx)
+	defer stopServer()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- hapServer.ListenAndServe(serverCtx)
+	}()
+
+	for {
+		select {
+		case <-reload:
+			if reloadConfig(*configPath, b, z2m) {
+				stopServer()
+				return true, <-done
+			}
+		case err := <-done:
+			return false, err
+		}
 	}
+}
 
+func setupHap(cfg config.Config, hapFs hap.Store, accessories []*accessory.A) *hap.Server {
 	// Setup HAP Bridge
 	hapBridge := accessory.NewBridge(accessory.Info{
 		Name: programName,
 	})
 	hapBridge.Id = 1
 	log.Infof("HAP Create Accessory %4d - %s (Bridge)", hapBridge.Id, hapBridge.A.Name())
+	log.Debugf("%d HAP Accessories", len(accessories))
 
-	// Setup HAP Accessories
-	var accessories []*accessory.A
-
-	makeDevices[*devices.TasmotaPlug](devices.NewTasmotaPlug, deviceOptions{
-		configs:     cfg.Devices.TasmotaPlugs,
-		offset:      2,
-		mqttClient:  mqttClient,
-		accessories: &accessories,
-	})
+	// Setup HAP server
+	hapServer, err := hap.NewServer(hapFs, hapBridge.A, accessories...)
+	if err != nil {
+		log.Fatal("Failed to create HAP server", "error", err)
+	}
 
-	makeDevices[*devices.EnOceanDimmer](devices.NewEnOceanDimmer, deviceOptions{
-		configs:     cfg.Devices.EnOceanDimmers,
-		offset:      100,
-		mqttClient:  mqttClient,
-		accessories: &accessories,
-	})
+	hapServer.Ifaces = cfg.Hap.Ifaces
+	hapServer.Addr = cfg.Hap.Addr
+	hapServer.Pin = cfg.Hap.Pin
 
-	makeDevices[*devices.TasmotaClimateSensor](devices.NewTasmotaClimateSensor, deviceOptions{
-		configs:     cfg.Devices.TasmotaClimateSensors,
-		offset:      200,
-		mqttClient:  mqttClient,
-		accessories: &accessories,
-	})
+	return hapServer
+}
 
-	makeDevices[*devices.ContactSensor](devices.NewContactSensor, deviceOptions{
-		configs:     cfg.Devices.ContactSensors,
-		offset:      300,
-		mqttClient:  mqttClient,
-		accessories: &accessories,
-	})
+func main() {
+	flag.Parse()
 
-	makeDevices[*devices.EnOceanLightbulb](devices.NewEnOceanLightbulb, deviceOptions{
-		configs:     cfg.Devices.EnOceanLightbulbs,
-		offset:      400,
-		mqttClient:  mqttClient,
-		accessories: &accessories,
-	})
+	// Do not output timestamp when running under systemd
+	if a, b := os.Getenv("INVOCATION_ID"), os.Getenv("JOURNAL_STREAM"); a != "" && b != "" {
+		log.SetReportTimestamp(false)
+	}
 
-	makeDevices[*devices.ShellyDimmer](devices.NewShellyDimmer, deviceOptions{
-		configs:     cfg.Devices.ShellyDimmers,
-		offset:      500,
-		mqttClient:  mqttClient,
-		accessories: &accessories,
-	})
+	if *debugHapLog {
+		haplog.Debug.Enable()
+	}
 
-	log.Debugf("%d HAP Accessories", len(accessories))
+	// Setup config
+	cfg := setupConfig(*configPath, *printConfig)
+	if *debugLog {
+		log.SetLevel(log.DebugLevel)
+	}
 
 	// Setup HAP filestore
 	err := os.MkdirAll(cfg.Hap.Dbdir, 0750)
@@ -218,22 +364,75 @@ func main() {
 	}
 	hapFs := hap.NewFsStore(cfg.Hap.Dbdir)
 
-	// Setup HAP server
-	hapServer, err := hap.NewServer(hapFs, hapBridge.A, accessories...)
+	ids, err := store.LoadIDs(cfg.Hap.Dbdir)
 	if err != nil {
-		log.Fatal("Failed to create HAP server", "error", err)
+		log.Fatal("Failed loading accessory IDs", "error", err)
 	}
 
-	hapServer.Ifaces = cfg.Hap.Ifaces
-	hapServer.Addr = cfg.Hap.Addr
-	hapServer.Pin = cfg.Hap.Pin
+	state, err := store.LoadState(cfg.Hap.Dbdir)
+	if err != nil {
+		log.Fatal("Failed loading accessory state", "error", err)
+	}
 
-	ctx := setupSignals()
-	log.Debug("Starting HAP server")
-	log.Debugf("%d Goroutines exist", runtime.NumGoroutine())
-	if err := hapServer.ListenAndServe(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Fatal("Failed to start HAP server", "error", err)
+	// Setup MQTT client
+	subs := devices.NewSubscriptions()
+	pub := devices.NewPublisher(cfg.Mqtt.PublishTimeout)
+	b := newBridge(subs, pub, ids, state)
+	mqttOpts := setupMqtt(cfg, b)
+	mqttClient := mqtt.NewClient(mqttOpts)
+	subs.SetClient(mqttClient)
+	pub.SetClient(mqttClient)
+
+	// Zigbee2MQTT devices are recreated like on a configuration reload
+	reload := setupReload()
+	var z2m *devices.Zigbee2MQTT
+	if cfg.Zigbee2MQTT.Enabled {
+		z2m = devices.NewZigbee2MQTT(cfg.Zigbee2MQTT.BaseTopic, cfg.Hap.Dbdir, func() {
+			select {
+			case reload <- syscall.SIGHUP:
+			default:
+			}
+		})
+		z2m.Listen(subs.Client(pub))
+	}
+
+	// Connect in the background, accessories are not responding until connected
+	log.Debug("Starting MQTT client")
+	mqttClient.Connect()
+
+	// Setup HAP Accessories
+	if err := b.update(deviceConfigs(cfg, z2m)); err != nil {
+		log.Fatal("Failed creating devices", "error", err)
+	}
+
+	ctx := setupSignals(func() {
+		// Replace the last will with a clean offline message
+		if mqttClient.IsConnectionOpen() {
+			publishAvailability(mqttClient, cfg, false)
+		}
+		mqttClient.Disconnect(250)
+	})
+	go state.Flush(ctx, time.Minute)
+	for {
+		// The HAP server cannot change its accessories while running, so
+		// it is recreated on reload. The changed configuration hash bumps
+		// the configuration number and HomeKit fetches the accessories again.
+		hapServer := setupHap(cfg, hapFs, b.accessories())
+		log.Debug("Starting HAP server")
+		log.Debugf("%d Goroutines exist", runtime.NumGoroutine())
+		restart, err := serveHap(ctx, hapServer, reload, b, z2m)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Failed to start HAP server", "error", err)
+		}
+		if !restart {
+			break
+		}
+	}
+
+	if err := state.Save(); err != nil {
+		log.Error("Failed saving accessory state", "error", err)
 	}
+	pub.LogStats()
 
 	log.Debugf("%d Goroutines exist", runtime.NumGoroutine())
 }
@@ -0,0 +1,25 @@
+package service
+
+import (
+	"senhaerens.be/hap-mqtt/characteristic"
+
+	"github.com/brutella/hap/service"
+)
+
+// TypeEveAirPressureSensor is the Eve air pressure sensor service.
+const TypeEveAirPressureSensor = "E863F00A-079E-48FF-8F27-9C2605A29F52"
+
+type EveAirPressureSensor struct {
+	*service.S
+	AirPressure *characteristic.EveAirPressure
+}
+
+func NewEveAirPressureSensor() *EveAirPressureSensor {
+	s := EveAirPressureSensor{}
+	s.S = service.New(TypeEveAirPressureSensor)
+
+	s.AirPressure = characteristic.NewEveAirPressure()
+	s.AddC(s.AirPressure.C)
+
+	return &s
+}
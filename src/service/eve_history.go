@@ -0,0 +1,37 @@
+package service
+
+import (
+	"senhaerens.be/hap-mqtt/characteristic"
+
+	"github.com/brutella/hap/service"
+)
+
+// TypeEveHistory is the Eve history service, also known as FakeGato.
+const TypeEveHistory = "E863F007-079E-48FF-8F27-9C2605A29F52"
+
+type EveHistory struct {
+	*service.S
+	Status  *characteristic.EveHistoryStatus
+	Entries *characteristic.EveHistoryEntries
+	Request *characteristic.EveHistoryRequest
+	SetTime *characteristic.EveSetTime
+}
+
+func NewEveHistory() *EveHistory {
+	s := EveHistory{}
+	s.S = service.New(TypeEveHistory)
+
+	s.Status = characteristic.NewEveHistoryStatus()
+	s.AddC(s.Status.C)
+
+	s.Entries = characteristic.NewEveHistoryEntries()
+	s.AddC(s.Entries.C)
+
+	s.Request = characteristic.NewEveHistoryRequest()
+	s.AddC(s.Request.C)
+
+	s.SetTime = characteristic.NewEveSetTime()
+	s.AddC(s.SetTime.C)
+
+	return &s
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const idsFile = "accessory_ids.json"
+
+// IDs assigns stable accessory IDs keyed by driver and device name.
+// IDs of removed devices are retired and never handed to another device.
+type IDs struct {
+	path string
+	used map[string]bool
+	mu   sync.Mutex
+
+	// Seeded is false until the first ID map is written. Until then
+	// the legacy index based IDs are adopted to keep existing pairings.
+	Seeded   bool              `json:"seeded"`
+	Next     uint64            `json:"next"`
+	Assigned map[string]uint64 `json:"assigned"`
+	Retired  map[string]uint64 `json:"retired"`
+}
+
+// LoadIDs reads the ID map from dir, or returns an empty one.
+func LoadIDs(dir string) (*IDs, error) {
+	s := &IDs{
+		path:     filepath.Join(dir, idsFile),
+		used:     map[string]bool{},
+		Next:     2, // 1 is the bridge
+		Assigned: map[string]uint64{},
+		Retired:  map[string]uint64{},
+	}
+
+	if err := readJSON(s.path, s); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func key(driver, name string) string {
+	return driver + "/" + name
+}
+
+// ID returns the accessory ID of a device, assigning a new one if needed.
+// The legacy ID is used while the map has never been saved, unless another
+// device already has it, e.g. when a driver had over 98 devices.
+func (s *IDs) ID(driver, name string, legacy uint64) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := key(driver, name)
+	s.used[k] = true
+	if id, ok := s.Assigned[k]; ok {
+		return id
+	}
+
+	id, ok := s.Retired[k]
+	if ok {
+		delete(s.Retired, k)
+	} else if !s.Seeded && legacy > 0 && !s.taken(legacy) {
+		id = legacy
+	} else {
+		id = s.Next
+	}
+
+	s.Assigned[k] = id
+	if id >= s.Next {
+		s.Next = id + 1
+	}
+
+	return id
+}
+
+func (s *IDs) taken(id uint64) bool {
+	for _, ids := range []map[string]uint64{s.Assigned, s.Retired} {
+		for _, other := range ids {
+			if other == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RetireUnused retires every assigned ID which was not requested with ID
+// since the previous call, i.e. the devices removed from the configuration.
+func (s *IDs) RetireUnused() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, id := range s.Assigned {
+		if !s.used[k] {
+			s.Retired[k] = id
+			delete(s.Assigned, k)
+		}
+	}
+	s.used = map[string]bool{}
+}
+
+// Save writes the ID map to disk.
+func (s *IDs) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Seeded = true
+	return writeJSON(s.path, s)
+}
+
+func readJSON(path string, v interface{}) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeJSON replaces the file atomically so a crash never leaves it truncated.
+func writeJSON(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,104 @@
+package store
+
+import "testing"
+
+func TestIDs(t *testing.T) {
+	// A step requests an ID, or retires the unused IDs, saves and reloads
+	type step struct {
+		name   string
+		legacy uint64
+		want   uint64
+		retire bool
+		reload bool
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "new IDs after the bridge",
+			steps: []step{
+				{name: "a", want: 2},
+				{name: "b", want: 3},
+				{name: "a", want: 2},
+			},
+		},
+		{
+			name: "legacy IDs adopted until seeded",
+			steps: []step{
+				{name: "a", legacy: 5, want: 5},
+				{name: "b", want: 6},
+				{reload: true},
+				{name: "c", legacy: 9, want: 7},
+			},
+		},
+		{
+			name: "legacy ID already assigned",
+			steps: []step{
+				{name: "a", legacy: 5, want: 5},
+				{name: "b", legacy: 5, want: 6},
+			},
+		},
+		{
+			name: "legacy ID of a retired device",
+			steps: []step{
+				{name: "a", legacy: 2, want: 2},
+				{retire: true},
+				{retire: true},
+				{name: "b", legacy: 2, want: 3},
+			},
+		},
+		{
+			name: "retired ID returned to its device",
+			steps: []step{
+				{name: "a", want: 2},
+				{name: "b", want: 3},
+				{retire: true},
+				{name: "a", want: 2},
+				{retire: true},
+				{reload: true},
+				{name: "c", want: 4},
+				{name: "b", want: 3},
+			},
+		},
+		{
+			name: "assigned IDs kept on reload",
+			steps: []step{
+				{name: "a", want: 2},
+				{name: "b", want: 3},
+				{reload: true},
+				{name: "b", want: 3},
+				{name: "a", want: 2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ids, err := LoadIDs(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, s := range tt.steps {
+				switch {
+				case s.retire:
+					ids.RetireUnused()
+				case s.reload:
+					if err := ids.Save(); err != nil {
+						t.Fatal(err)
+					}
+					if ids, err = LoadIDs(dir); err != nil {
+						t.Fatal(err)
+					}
+				default:
+					if got := ids.ID("driver", s.name, s.legacy); got != s.want {
+						t.Errorf("step %d: ID(%q, %d) = %d, want %d", i, s.name, s.legacy, got, s.want)
+					}
+				}
+			}
+		})
+	}
+}
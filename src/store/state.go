@@ -0,0 +1,167 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/charmbracelet/log"
+)
+
+const stateFile = "accessory_state.json"
+
+// State persists the last known characteristic values and additional
+// device state per accessory, so restarts do not reset accessories.
+type State struct {
+	path  string
+	mu    sync.Mutex
+	dirty bool
+
+	Accessories map[string]map[string]json.RawMessage `json:"accessories"`
+}
+
+// LoadState reads the state from dir, or returns an empty one.
+func LoadState(dir string) (*State, error) {
+	s := &State{
+		path:        filepath.Join(dir, stateFile),
+		Accessories: map[string]map[string]json.RawMessage{},
+	}
+
+	if err := readJSON(s.path, s); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Scope returns the state of a single accessory.
+func (s *State) Scope(aid uint64) *Scope {
+	return &Scope{state: s, aid: strconv.FormatUint(aid, 10)}
+}
+
+// Track restores the characteristic values of the accessory and records
+// every later change. Stateless events, e.g. button presses, and hidden
+// characteristics, e.g. the Eve history, are left out.
+func (s *State) Track(a *accessory.A) {
+	scope := s.Scope(a.Id)
+
+	for i, svc := range a.Ss {
+		if svc.Type == service.TypeAccessoryInformation {
+			continue
+		}
+
+		for _, c := range svc.Cs {
+			if !c.IsReadable() || c.Type == characteristic.TypeProgrammableSwitchEvent || slices.Contains(c.Permissions, characteristic.PermissionHidden) {
+				continue
+			}
+
+			key := fmt.Sprintf("c/%d/%s", i, c.Type)
+			var v interface{}
+			if scope.Get(key, &v) && v != nil {
+				c.SetValueRequest(v, nil)
+			}
+
+			c.OnCValueUpdate(func(c *characteristic.C, new, _ interface{}, _ *http.Request) {
+				scope.Set(key, new)
+			})
+		}
+	}
+}
+
+// Prune drops the state of accessories not in use.
+func (s *State) Prune(inUse map[uint64]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for aid := range s.Accessories {
+		id, err := strconv.ParseUint(aid, 10, 64)
+		if err != nil || !inUse[id] {
+			delete(s.Accessories, aid)
+			s.dirty = true
+		}
+	}
+}
+
+// Save writes the state to disk if it changed.
+func (s *State) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+	s.dirty = false
+
+	return writeJSON(s.path, s)
+}
+
+// Flush saves the state periodically until ctx is done.
+func (s *State) Flush(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				log.Error("Failed saving accessory state", "error", err)
+			}
+		}
+	}
+}
+
+// Scope is the persisted state of a single accessory.
+type Scope struct {
+	state *State
+	aid   string
+}
+
+// Get decodes the value stored under key into v and reports whether it exists.
+func (sc *Scope) Get(key string, v interface{}) bool {
+	sc.state.mu.Lock()
+	raw, ok := sc.state.Accessories[sc.aid][key]
+	sc.state.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		log.Error("Failed decoding accessory state", "key", key, "error", err)
+		return false
+	}
+
+	return true
+}
+
+// Set stores v under key.
+func (sc *Scope) Set(key string, v interface{}) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		log.Error("Failed encoding accessory state", "key", key, "error", err)
+		return
+	}
+
+	sc.state.mu.Lock()
+	defer sc.state.mu.Unlock()
+
+	values, ok := sc.state.Accessories[sc.aid]
+	if !ok {
+		values = map[string]json.RawMessage{}
+		sc.state.Accessories[sc.aid] = values
+	}
+	values[key] = raw
+	sc.state.dirty = true
+}